@@ -5,26 +5,37 @@ import (
 	"encoding/json"
 	"errors"
 	"flag"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"octaroute/internal/auth"
 	"octaroute/internal/config"
 	"octaroute/internal/controllerdb"
+	"octaroute/internal/controlplane"
 	"octaroute/internal/netutil"
 )
 
 type apiServer struct {
-	store *controllerdb.Store
+	store        *controllerdb.Store
+	pusher       *controlplane.Pusher
+	pushOnChange bool
 }
 
 func main() {
-	var configPath string
+	var (
+		configPath  string
+		migrateOnly bool
+	)
 	flag.StringVar(&configPath, "config", "", "Path to JSON config")
+	flag.BoolVar(&migrateOnly, "migrate-only", false, "Apply database migrations and exit")
 	flag.Parse()
 
 	cfg, err := config.Load(configPath)
@@ -32,11 +43,25 @@ func main() {
 		log.Fatalf("load config: %v", err)
 	}
 
+	if migrateOnly {
+		store, err := controllerdb.Open(cfg.Database)
+		if err != nil {
+			log.Fatalf("open database: %v", err)
+		}
+		defer store.Close()
+		version, err := store.SchemaVersion(context.Background())
+		if err != nil {
+			log.Fatalf("read schema version: %v", err)
+		}
+		log.Printf("controller database %s at schema version %d", cfg.Database, version)
+		return
+	}
+
 	if !cfg.Server.BindTailscale {
 		log.Fatal("server.bindTailscale must be true to bind tailscale0")
 	}
-	if cfg.Auth.APIKey == "" {
-		log.Fatal("auth.apiKey must be set")
+	if len(cfg.Auth.KeyMap()) == 0 {
+		log.Fatal("auth.apiKey or auth.keys must be set")
 	}
 
 	store, err := controllerdb.Open(cfg.Database)
@@ -45,15 +70,41 @@ func main() {
 	}
 	defer store.Close()
 
-	api := &apiServer{store: store}
+	pusher := &controlplane.Pusher{
+		Store:         store,
+		Client:        &http.Client{Timeout: time.Duration(cfg.Push.TimeoutSeconds) * time.Second},
+		APIKey:        cfg.Push.GatewayAPIKey,
+		Header:        cfg.Push.GatewayHeader,
+		MaxAttempts:   cfg.Push.MaxAttempts,
+		RetryInterval: time.Duration(cfg.Push.RetryIntervalSeconds) * time.Second,
+	}
+
+	api := &apiServer{store: store, pusher: pusher, pushOnChange: cfg.Push.OnChange}
+	keys := cfg.Auth.KeyMap()
+	protect := func(h http.HandlerFunc) http.Handler {
+		return auth.RequireAPIKeys(withActor(h), keys, cfg.Auth.Header)
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("ok"))
 	})
-	mux.Handle("/api/nodes", auth.RequireAPIKey(http.HandlerFunc(api.handleNodes), cfg.Auth.APIKey, cfg.Auth.Header))
-	mux.Handle("/api/policies", auth.RequireAPIKey(http.HandlerFunc(api.handlePolicies), cfg.Auth.APIKey, cfg.Auth.Header))
-	mux.Handle("/api/routes", auth.RequireAPIKey(http.HandlerFunc(api.handleRoutes), cfg.Auth.APIKey, cfg.Auth.Header))
+	mux.Handle("/api/nodes", protect(api.handleNodes))
+	mux.Handle("/api/nodes/", protect(api.handleNode))
+	mux.Handle("/api/policies", protect(api.handlePolicies))
+	mux.Handle("/api/policies/", protect(api.handlePolicy))
+	mux.Handle("/api/routes", protect(api.handleRoutes))
+	mux.Handle("/api/routes/", protect(api.handleRoute))
+	mux.Handle("/api/zones", protect(api.handleZones))
+	mux.Handle("/api/zones/", protect(api.handleZone))
+	mux.Handle("/api/changeset", protect(api.handleChangeset))
+	mux.Handle("/api/changeset/", protect(api.handleChangeset))
+	mux.Handle("/api/revisions", protect(api.handleRevisions))
+	mux.Handle("/api/revisions/", protect(api.handleRevisions))
+	mux.Handle("/api/audit", protect(api.handleAudit))
+	mux.Handle("/api/compile", protect(api.handleCompile))
+	mux.Handle("/api/push", protect(api.handlePush))
 
 	server := &http.Server{
 		Addr:              cfg.Server.Address,
@@ -69,6 +120,8 @@ func main() {
 		log.Fatalf("listen: %v", err)
 	}
 
+	go pusher.Run(ctx)
+
 	go func() {
 		<-ctx.Done()
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -82,6 +135,15 @@ func main() {
 	}
 }
 
+// withActor attributes store writes made by the request to the API key that
+// authenticated it.
+func withActor(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := controllerdb.WithActor(r.Context(), auth.Identity(r.Context()))
+		next(w, r.WithContext(ctx))
+	}
+}
+
 func logRequests(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("%s %s", r.Method, r.URL.Path)
@@ -104,15 +166,16 @@ func (a *apiServer) handleNodes(w http.ResponseWriter, r *http.Request) {
 			writeError(w, http.StatusBadRequest, err)
 			return
 		}
-		if n.Name == "" || n.Address == "" || n.Zone == "" {
-			writeError(w, http.StatusBadRequest, errMissingFields)
+		if err := validateNode(n); err != nil {
+			writeError(w, http.StatusBadRequest, err)
 			return
 		}
 		created, err := a.store.CreateNode(r.Context(), n)
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
+			writeStoreError(w, err)
 			return
 		}
+		a.changed()
 		writeJSON(w, http.StatusCreated, created)
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -134,13 +197,13 @@ func (a *apiServer) handlePolicies(w http.ResponseWriter, r *http.Request) {
 			writeError(w, http.StatusBadRequest, err)
 			return
 		}
-		if p.Name == "" || p.Source == "" || p.Destination == "" || p.Action == "" {
-			writeError(w, http.StatusBadRequest, errMissingFields)
+		if err := validatePolicy(p); err != nil {
+			writeError(w, http.StatusBadRequest, err)
 			return
 		}
 		created, err := a.store.CreatePolicy(r.Context(), p)
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
+			writeStoreError(w, err)
 			return
 		}
 		writeJSON(w, http.StatusCreated, created)
@@ -164,22 +227,505 @@ func (a *apiServer) handleRoutes(w http.ResponseWriter, r *http.Request) {
 			writeError(w, http.StatusBadRequest, err)
 			return
 		}
-		if rt.CIDR == "" || rt.NextHop == "" || rt.NodeID == 0 {
-			writeError(w, http.StatusBadRequest, errMissingFields)
+		if err := validateRoute(rt); err != nil {
+			writeError(w, http.StatusBadRequest, err)
 			return
 		}
 		created, err := a.store.CreateRoute(r.Context(), rt)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		a.changed()
+		writeJSON(w, http.StatusCreated, created)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *apiServer) handleNode(w http.ResponseWriter, r *http.Request) {
+	id, ok := resourceID(w, r, "/api/nodes/")
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		n, err := a.store.GetNode(r.Context(), id)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, n)
+	case http.MethodPut, http.MethodPatch:
+		var n controllerdb.Node
+		if r.Method == http.MethodPatch {
+			existing, err := a.store.GetNode(r.Context(), id)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			n = existing
+		}
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		n.ID = id
+		if err := validateNode(n); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		updated, err := a.store.UpdateNode(r.Context(), n)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		a.changed()
+		writeJSON(w, http.StatusOK, updated)
+	case http.MethodDelete:
+		deletion, err := a.store.DeleteNode(r.Context(), id)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		a.changed()
+		writeJSON(w, http.StatusOK, deletion)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *apiServer) handlePolicy(w http.ResponseWriter, r *http.Request) {
+	id, ok := resourceID(w, r, "/api/policies/")
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		p, err := a.store.GetPolicy(r.Context(), id)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, p)
+	case http.MethodPut, http.MethodPatch:
+		var p controllerdb.Policy
+		if r.Method == http.MethodPatch {
+			existing, err := a.store.GetPolicy(r.Context(), id)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			p = existing
+		}
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		p.ID = id
+		if err := validatePolicy(p); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		updated, err := a.store.UpdatePolicy(r.Context(), p)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, updated)
+	case http.MethodDelete:
+		deleted, err := a.store.DeletePolicy(r.Context(), id)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, deleted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *apiServer) handleRoute(w http.ResponseWriter, r *http.Request) {
+	id, ok := resourceID(w, r, "/api/routes/")
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		rt, err := a.store.GetRoute(r.Context(), id)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, rt)
+	case http.MethodPut, http.MethodPatch:
+		var rt controllerdb.Route
+		if r.Method == http.MethodPatch {
+			existing, err := a.store.GetRoute(r.Context(), id)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			rt = existing
+		}
+		if err := json.NewDecoder(r.Body).Decode(&rt); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		rt.ID = id
+		if err := validateRoute(rt); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		updated, err := a.store.UpdateRoute(r.Context(), rt)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		a.changed()
+		writeJSON(w, http.StatusOK, updated)
+	case http.MethodDelete:
+		deleted, err := a.store.DeleteRoute(r.Context(), id)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		a.changed()
+		writeJSON(w, http.StatusOK, deleted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *apiServer) handleZones(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		zones, err := a.store.ListZones(r.Context())
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
+		writeJSON(w, http.StatusOK, zones)
+	case http.MethodPost:
+		var z controllerdb.Zone
+		if err := json.NewDecoder(r.Body).Decode(&z); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := validateZone(z); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		created, err := a.store.CreateZone(r.Context(), z)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		a.changed()
 		writeJSON(w, http.StatusCreated, created)
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
-var errMissingFields = &apiError{Message: "missing required fields"}
+func (a *apiServer) handleZone(w http.ResponseWriter, r *http.Request) {
+	id, ok := resourceID(w, r, "/api/zones/")
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		z, err := a.store.GetZone(r.Context(), id)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, z)
+	case http.MethodPut, http.MethodPatch:
+		var z controllerdb.Zone
+		if r.Method == http.MethodPatch {
+			existing, err := a.store.GetZone(r.Context(), id)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			z = existing
+		}
+		if err := json.NewDecoder(r.Body).Decode(&z); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		z.ID = id
+		if err := validateZone(z); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		updated, err := a.store.UpdateZone(r.Context(), z)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		a.changed()
+		writeJSON(w, http.StatusOK, updated)
+	case http.MethodDelete:
+		deleted, err := a.store.DeleteZone(r.Context(), id)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		a.changed()
+		writeJSON(w, http.StatusOK, deleted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func validateZone(z controllerdb.Zone) error {
+	if z.Name == "" {
+		return errMissingFields
+	}
+	for _, cidr := range z.CIDRs {
+		if _, _, err := net.ParseCIDR(strings.TrimSpace(cidr)); err != nil {
+			return &apiError{Message: "invalid cidr " + cidr}
+		}
+	}
+	return nil
+}
+
+func validateNode(n controllerdb.Node) error {
+	if n.Name == "" || n.Address == "" || n.Zone == "" {
+		return errMissingFields
+	}
+	if n.Role != "" && n.Role != controllerdb.RoleGateway && n.Role != controllerdb.RoleExit {
+		return errInvalidRole
+	}
+	return nil
+}
+
+func validatePolicy(p controllerdb.Policy) error {
+	if p.Name == "" || p.Source == "" || p.Destination == "" || p.Action == "" {
+		return errMissingFields
+	}
+	return nil
+}
+
+func validateRoute(rt controllerdb.Route) error {
+	if rt.CIDR == "" || rt.NextHop == "" || rt.NodeID == 0 {
+		return errMissingFields
+	}
+	return nil
+}
+
+// resourceID parses the numeric ID following prefix in the request path,
+// writing a 404 when it is missing or malformed.
+func resourceID(w http.ResponseWriter, r *http.Request, prefix string) (int64, bool) {
+	raw := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	id, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || id <= 0 || strings.Contains(raw, "/") {
+		writeError(w, http.StatusNotFound, errUnknownResource)
+		return 0, false
+	}
+	return id, true
+}
+
+func (a *apiServer) handleChangeset(w http.ResponseWriter, r *http.Request) {
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/changeset"), "/")
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		cs, err := a.store.Changeset(r.Context())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, cs)
+	case action == "publish" && r.Method == http.MethodPost:
+		var body struct {
+			Message string `json:"message"`
+		}
+		if err := decodeOptionalJSON(r, &body); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		rev, err := a.store.Publish(r.Context(), body.Message)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		a.changed()
+		writeJSON(w, http.StatusCreated, rev)
+	case action == "discard" && r.Method == http.MethodPost:
+		discarded, err := a.store.DiscardDraft(r.Context())
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, discarded)
+	case action == "" || action == "publish" || action == "discard":
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	default:
+		writeError(w, http.StatusNotFound, errUnknownResource)
+	}
+}
+
+func (a *apiServer) handleRevisions(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/revisions"), "/")
+	if rest == "" {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		revisions, err := a.store.ListRevisions(r.Context())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, revisions)
+		return
+	}
+	raw, action, _ := strings.Cut(rest, "/")
+	number, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || number <= 0 || (action != "" && action != "restore") {
+		writeError(w, http.StatusNotFound, errUnknownResource)
+		return
+	}
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		rev, err := a.store.GetRevision(r.Context(), number)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, rev)
+	case action == "restore" && r.Method == http.MethodPost:
+		var body struct {
+			Message string `json:"message"`
+		}
+		if err := decodeOptionalJSON(r, &body); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		rev, err := a.store.RestoreRevision(r.Context(), number, body.Message)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		a.changed()
+		writeJSON(w, http.StatusCreated, rev)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// decodeOptionalJSON decodes the request body into v, accepting an empty body.
+func decodeOptionalJSON(r *http.Request, v any) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+func (a *apiServer) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	filter := controllerdb.AuditFilter{
+		Resource: q.Get("resource"),
+		Actor:    q.Get("actor"),
+		Limit:    100,
+	}
+	var err error
+	if v := q.Get("resourceId"); v != "" {
+		if filter.ResourceID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, &apiError{Message: "invalid resourceId"})
+			return
+		}
+	}
+	if v := q.Get("since"); v != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			writeError(w, http.StatusBadRequest, &apiError{Message: "since must be RFC 3339"})
+			return
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			writeError(w, http.StatusBadRequest, &apiError{Message: "until must be RFC 3339"})
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit <= 0 {
+			writeError(w, http.StatusBadRequest, &apiError{Message: "invalid limit"})
+			return
+		}
+	}
+	entries, err := a.store.ListAudit(r.Context(), filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func (a *apiServer) handleCompile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	in, err := controlplane.LoadInputs(r.Context(), a.store)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	requests, err := controlplane.Compile(in)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, requests)
+}
+
+func (a *apiServer) handlePush(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		statuses, err := a.store.ListPushStatus(r.Context())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, statuses)
+	case http.MethodPost:
+		statuses, err := a.pusher.PushAll(r.Context())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		status := http.StatusOK
+		for _, ps := range statuses {
+			if !ps.Success {
+				status = http.StatusBadGateway
+			}
+		}
+		writeJSON(w, status, statuses)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// changed schedules a push after a successful write when push.onChange is set.
+func (a *apiServer) changed() {
+	if a.pushOnChange {
+		a.pusher.Trigger()
+	}
+}
+
+var (
+	errMissingFields   = &apiError{Message: "missing required fields"}
+	errInvalidRole     = &apiError{Message: "role must be gateway or exit"}
+	errUnknownResource = &apiError{Message: "resource not found"}
+)
 
 func writeJSON(w http.ResponseWriter, status int, payload any) {
 	w.Header().Set("Content-Type", "application/json")
@@ -199,6 +745,23 @@ func writeError(w http.ResponseWriter, status int, err error) {
 	writeJSON(w, status, apiError{Message: err.Error()})
 }
 
+func writeStoreError(w http.ResponseWriter, err error) {
+	if errors.Is(err, controllerdb.ErrNotFound) {
+		writeError(w, http.StatusNotFound, errUnknownResource)
+		return
+	}
+	if errors.Is(err, controllerdb.ErrInvalidReference) {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if errors.Is(err, controllerdb.ErrDuplicate) || errors.Is(err, controllerdb.ErrInUse) || errors.Is(err, controllerdb.ErrNoChanges) ||
+		errors.Is(err, controllerdb.ErrZoneDeleted) {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err)
+}
+
 func init() {
 	if _, ok := os.LookupEnv("TZ"); !ok {
 		_ = os.Setenv("TZ", "UTC")
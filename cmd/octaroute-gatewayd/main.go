@@ -3,7 +3,9 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
@@ -17,8 +19,12 @@ import (
 )
 
 func main() {
-	var configPath string
+	var (
+		configPath  string
+		migrateOnly bool
+	)
 	flag.StringVar(&configPath, "config", "", "Path to JSON config")
+	flag.BoolVar(&migrateOnly, "migrate-only", false, "Apply database migrations and exit")
 	flag.Parse()
 
 	cfg, err := config.Load(configPath)
@@ -34,13 +40,62 @@ func main() {
 		_ = stateStore.Close()
 	}()
 
+	if migrateOnly {
+		version, err := stateStore.SchemaVersion(context.Background())
+		if err != nil {
+			log.Fatalf("read schema version: %v", err)
+		}
+		log.Printf("routing state database %s at schema version %d", cfg.Database, version)
+		return
+	}
+
+	if cfg.Gateway.TableIDMin > cfg.Gateway.TableIDMax || cfg.Gateway.FwmarkMin > cfg.Gateway.FwmarkMax {
+		log.Fatalf("gateway table ID and fwmark ranges must have min <= max")
+	}
 	manager := &routing.Manager{
+		Allocator: &routing.Allocator{
+			Store:      stateStore,
+			TableIDMin: cfg.Gateway.TableIDMin,
+			TableIDMax: cfg.Gateway.TableIDMax,
+			MarkMin:    cfg.Gateway.FwmarkMin,
+			MarkMax:    cfg.Gateway.FwmarkMax,
+		},
 		DNS: &routing.DNSProxy{
-			ListenAddr: cfg.DNS.ListenAddress,
-			Upstream:   cfg.DNS.Upstream,
+			ListenAddr:     cfg.DNS.ListenAddress,
+			Upstream:       cfg.DNS.Upstream,
+			Upstreams:      cfg.DNS.Upstreams,
+			Strategy:       cfg.DNS.Strategy,
+			HealthInterval: time.Duration(cfg.DNS.HealthCheckIntervalSeconds) * time.Second,
+			MinTTL:         time.Duration(cfg.DNS.MinTTLSeconds) * time.Second,
+			MaxTTL:         time.Duration(cfg.DNS.MaxTTLSeconds) * time.Second,
+			WaitForSets:    cfg.DNS.WaitForSets,
+			BatchWindow:    time.Duration(cfg.DNS.BatchWindowMillis) * time.Millisecond,
+			CacheSize:      cfg.DNS.CacheSize,
+			ServeStale:     time.Duration(cfg.DNS.ServeStaleSeconds) * time.Second,
+			Prefetch:       cfg.DNS.Prefetch,
+			BlockResponse:  cfg.DNS.BlockResponse,
 		},
 	}
 
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var restore *restoreStatus
+	if cfg.Gateway.RestoreOnStart {
+		restore = restoreState(ctx, manager, stateStore)
+	}
+
+	var reconciler *routing.Reconciler
+	if cfg.Gateway.ReconcileIntervalSeconds > 0 {
+		reconciler = &routing.Reconciler{
+			Manager:  manager,
+			Store:    stateStore,
+			Interval: time.Duration(cfg.Gateway.ReconcileIntervalSeconds) * time.Second,
+			Repair:   cfg.Gateway.RepairDrift,
+		}
+		go reconciler.Run(ctx)
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -52,18 +107,33 @@ func main() {
 			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 			return
 		}
-		if !ok {
-			writeJSON(w, http.StatusOK, map[string]any{
-				"applied": false,
-			})
+		body := map[string]any{"applied": ok}
+		if ok {
+			body["state"] = state
+		}
+		allocations, err := manager.Allocator.Allocations(r.Context())
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 			return
 		}
-		writeJSON(w, http.StatusOK, map[string]any{
-			"applied": true,
-			"state":   state,
-		})
+		body["allocations"] = allocations
+		if restore != nil {
+			body["restore"] = restore
+		}
+		if reconciler != nil {
+			body["reconcile"] = reconciler.Status()
+		}
+		body["dns"] = manager.DNS.Status()
+		writeJSON(w, http.StatusOK, body)
 	}))
-	mux.HandleFunc("/apply", requireAPIKey(cfg, func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/dns/learned", requireAPIKey(cfg, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, manager.DNS.Attributions())
+	}))
+	mux.HandleFunc("/plan", requireAPIKey(cfg, func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
@@ -73,13 +143,49 @@ func main() {
 			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json"})
 			return
 		}
-		state, err := manager.Apply(r.Context(), req)
+		plan, err := manager.Plan(r.Context(), stateStore, req)
+		var storeErr *routing.StateStoreError
+		if errors.As(err, &storeErr) {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": storeErr.Err.Error()})
+			return
+		}
 		if err != nil {
-			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 			return
 		}
-		if err := stateStore.Save(r.Context(), state); err != nil {
-			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		writeJSON(w, http.StatusOK, plan)
+	}))
+	mux.HandleFunc("/apply", requireAPIKey(cfg, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var req routing.ApplyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json"})
+			return
+		}
+		state, err := manager.ApplyStored(r.Context(), stateStore, req)
+		var applyErr *routing.ApplyError
+		if errors.As(err, &applyErr) {
+			body := map[string]any{
+				"error":      applyErr.Err.Error(),
+				"step":       applyErr.Step,
+				"rolledBack": applyErr.RolledBack,
+			}
+			if applyErr.RollbackErr != nil {
+				body["rollbackError"] = applyErr.RollbackErr.Error()
+			}
+			writeJSON(w, http.StatusInternalServerError, body)
+			return
+		}
+		var storeErr *routing.StateStoreError
+		if errors.As(err, &storeErr) {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": storeErr.Err.Error()})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 			return
 		}
 		writeJSON(w, http.StatusOK, state)
@@ -91,9 +197,6 @@ func main() {
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 
-	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
-	defer stop()
-
 	ln, err := netutil.ListenWithOptionalDevice(ctx, "tcp", cfg.Server.Address, "tailscale0")
 	if err != nil {
 		log.Fatalf("listen: %v", err)
@@ -112,6 +215,46 @@ func main() {
 	}
 }
 
+// restoreStatus is the outcome of re-applying the saved routing state at
+// startup, reported on /status.
+type restoreStatus struct {
+	At       time.Time `json:"at"`
+	Restored bool      `json:"restored"`
+	Step     string    `json:"step,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// restoreState re-applies the last saved routing state so the kernel matches
+// it again after a reboot. Failures are logged and reported, not fatal: the
+// gateway still serves so the controller can push a fresh state.
+func restoreState(ctx context.Context, manager *routing.Manager, store *routing.StateStore) *restoreStatus {
+	status := &restoreStatus{At: time.Now().UTC()}
+	state, ok, err := store.Load(ctx)
+	if err != nil {
+		status.Error = fmt.Sprintf("load saved state: %v", err)
+		log.Printf("restore routing state: %s", status.Error)
+		return status
+	}
+	if !ok {
+		log.Printf("restore routing state: no saved state")
+		return status
+	}
+	// The saved state doubles as the rollback target: after a plain restart
+	// it is still what the kernel holds.
+	if _, err := manager.Apply(ctx, state, state.Request()); err != nil {
+		var applyErr *routing.ApplyError
+		if errors.As(err, &applyErr) {
+			status.Step = applyErr.Step
+		}
+		status.Error = err.Error()
+		log.Printf("restore routing state applied at %s failed: %v", state.AppliedAt.Format(time.RFC3339), err)
+		return status
+	}
+	status.Restored = true
+	log.Printf("restored routing state applied at %s (%d nodes, %d policies)", state.AppliedAt.Format(time.RFC3339), len(state.Nodes), len(state.Policies))
+	return status
+}
+
 func logRequests(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("%s %s", r.Method, r.URL.Path)
@@ -125,7 +268,7 @@ func requireAPIKey(cfg *config.Config, next http.HandlerFunc) http.HandlerFunc {
 			next(w, r)
 			return
 		}
-		if r.Header.Get("X-API-Key") != cfg.Server.APIKey {
+		if r.Header.Get(cfg.Auth.Header) != cfg.Server.APIKey {
 			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
 			return
 		}
@@ -1,16 +1,45 @@
 package auth
 
 import (
+	"context"
 	"crypto/subtle"
 	"net/http"
+	"sort"
 )
 
 const DefaultHeader = "X-API-Key"
 
+// DefaultIdentity names the caller authenticated by a single unnamed key.
+const DefaultIdentity = "default"
+
+type identityKey struct{}
+
+// Identity returns the name of the API key that authenticated the request
+// carrying ctx, or "" when the request was not authenticated.
+func Identity(ctx context.Context) string {
+	identity, _ := ctx.Value(identityKey{}).(string)
+	return identity
+}
+
 func RequireAPIKey(next http.Handler, apiKey, header string) http.Handler {
+	keys := map[string]string{}
+	if apiKey != "" {
+		keys[DefaultIdentity] = apiKey
+	}
+	return RequireAPIKeys(next, keys, header)
+}
+
+// RequireAPIKeys accepts any of keys, which maps identity names to keys, and
+// records the matching identity on the request context. If several
+// identities share a key, the first by name is recorded.
+func RequireAPIKeys(next http.Handler, keys map[string]string, header string) http.Handler {
+	ids := make([]string, 0, len(keys))
+	for id := range keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		expected := apiKey
-		if expected == "" {
+		if len(keys) == 0 {
 			http.Error(w, "missing api key configuration", http.StatusUnauthorized)
 			return
 		}
@@ -18,12 +47,19 @@ func RequireAPIKey(next http.Handler, apiKey, header string) http.Handler {
 		if name == "" {
 			name = DefaultHeader
 		}
-		provided := r.Header.Get(name)
-		if subtle.ConstantTimeCompare([]byte(provided), []byte(expected)) != 1 {
+		provided := []byte(r.Header.Get(name))
+		identity := ""
+		for _, id := range ids {
+			key := keys[id]
+			if key != "" && subtle.ConstantTimeCompare(provided, []byte(key)) == 1 && identity == "" {
+				identity = id
+			}
+		}
+		if identity == "" {
 			http.Error(w, "invalid api key", http.StatusUnauthorized)
 			return
 		}
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, identity)))
 	})
 }
 
@@ -15,13 +15,115 @@ type ServerConfig struct {
 
 type DNSConfig struct {
 	ListenAddress string `json:"listenAddress"`
-	Upstream      string `json:"upstream"`
+	// Upstream is a udp://, tcp://, tls:// or https:// resolver URI; a
+	// bare host:port means UDP.
+	Upstream string `json:"upstream"`
+	// Upstreams lists several resolvers, used instead of Upstream when
+	// set. Strategy picks between them: "failover" (default),
+	// "round-robin" or "fastest".
+	Upstreams []string `json:"upstreams"`
+	Strategy  string   `json:"strategy"`
+	// HealthCheckIntervalSeconds is how often upstreams are probed.
+	HealthCheckIntervalSeconds int `json:"healthCheckIntervalSeconds"`
+	// MinTTLSeconds and MaxTTLSeconds bound how long a resolved address
+	// stays in a policy's nft set.
+	MinTTLSeconds int `json:"minTtlSeconds"`
+	MaxTTLSeconds int `json:"maxTtlSeconds"`
+	// WaitForSets delays each reply until its addresses are in the nft
+	// sets.
+	WaitForSets bool `json:"waitForSets"`
+	// BatchWindowMillis is how long learned addresses are coalesced before
+	// being written to the sets.
+	BatchWindowMillis int `json:"batchWindowMillis"`
+	// CacheSize bounds the response cache in entries; 0 disables it.
+	CacheSize int `json:"cacheSize"`
+	// ServeStaleSeconds is how long past expiry a cached answer may be
+	// served when every upstream fails.
+	ServeStaleSeconds int `json:"serveStaleSeconds"`
+	// Prefetch refreshes frequently queried answers before they expire.
+	Prefetch bool `json:"prefetch"`
+	// BlockResponse is how names of deny policies are answered:
+	// "nxdomain" (default), "null" or "refused".
+	BlockResponse string `json:"blockResponse"`
 }
 
 // AuthConfig defines the API key header used by control endpoints.
 type AuthConfig struct {
-	APIKey string `json:"apiKey"`
-	Header string `json:"header"`
+	APIKey string         `json:"apiKey"`
+	Header string         `json:"header"`
+	Keys   []APIKeyConfig `json:"keys"`
+}
+
+// APIKeyConfig is a named API key; the name is recorded as the actor in the
+// controller audit log.
+type APIKeyConfig struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+// KeyMap returns the configured keys by identity name. A bare apiKey is
+// exposed under the "default" identity. A key value already claimed by an
+// earlier identity is left out, so every key maps to exactly one identity.
+func (a AuthConfig) KeyMap() map[string]string {
+	keys := make(map[string]string, len(a.Keys)+1)
+	seen := make(map[string]bool, len(a.Keys)+1)
+	if a.APIKey != "" {
+		keys["default"] = a.APIKey
+		seen[a.APIKey] = true
+	}
+	for _, k := range a.Keys {
+		if k.Name != "" && k.Key != "" && !seen[k.Key] {
+			if _, ok := keys[k.Name]; !ok {
+				keys[k.Name] = k.Key
+				seen[k.Key] = true
+			}
+		}
+	}
+	return keys
+}
+
+// Validate rejects keys that share a name or a key value, since the audit
+// log could not tell their callers apart.
+func (a AuthConfig) Validate() error {
+	names := make(map[string]bool, len(a.Keys)+1)
+	values := make(map[string]string, len(a.Keys)+1)
+	if a.APIKey != "" {
+		names["default"] = true
+		values[a.APIKey] = "default"
+	}
+	for _, k := range a.Keys {
+		if k.Name == "" || k.Key == "" {
+			continue
+		}
+		if names[k.Name] {
+			return fmt.Errorf("auth key %q is defined more than once", k.Name)
+		}
+		if other, ok := values[k.Key]; ok {
+			return fmt.Errorf("auth keys %q and %q share the same key", other, k.Name)
+		}
+		names[k.Name] = true
+		values[k.Key] = k.Name
+	}
+	return nil
+}
+
+// GatewayConfig holds settings specific to octaroute-gatewayd.
+type GatewayConfig struct {
+	// RestoreOnStart re-applies the last saved routing state before the
+	// gateway starts serving.
+	RestoreOnStart bool `json:"restoreOnStart"`
+	// ReconcileIntervalSeconds is how often the live kernel state is
+	// compared with the saved routing state; 0 disables the check.
+	ReconcileIntervalSeconds int `json:"reconcileIntervalSeconds"`
+	// RepairDrift re-applies the saved state when drift is found instead
+	// of only reporting it.
+	RepairDrift bool `json:"repairDrift"`
+	// TableIDMin/TableIDMax and FwmarkMin/FwmarkMax bound the route table
+	// IDs and fwmarks allocated to egress nodes.
+	TableIDMin int `json:"tableIdMin"`
+	TableIDMax int `json:"tableIdMax"`
+	FwmarkMin  int `json:"fwmarkMin"`
+	FwmarkMax  int `json:"fwmarkMax"`
 }
 
 // WireGuardConfig describes the exit node WireGuard interface settings.
@@ -33,6 +135,17 @@ type WireGuardConfig struct {
 	Address        string `json:"address"`
 }
 
+// PushConfig controls how the controller delivers compiled policies to
+// gateway nodes.
+type PushConfig struct {
+	GatewayAPIKey        string `json:"gatewayApiKey"`
+	GatewayHeader        string `json:"gatewayHeader"`
+	TimeoutSeconds       int    `json:"timeoutSeconds"`
+	MaxAttempts          int    `json:"maxAttempts"`
+	RetryIntervalSeconds int    `json:"retryIntervalSeconds"`
+	OnChange             bool   `json:"onChange"`
+}
+
 // NATConfig defines nftables masquerade settings.
 type NATConfig struct {
 	Enable            bool   `json:"enable"`
@@ -45,8 +158,11 @@ type Config struct {
 	Server    ServerConfig    `json:"server"`
 	Database  string          `json:"database"`
 	Auth      AuthConfig      `json:"auth"`
+	DNS       DNSConfig       `json:"dns"`
+	Gateway   GatewayConfig   `json:"gateway"`
 	WireGuard WireGuardConfig `json:"wireguard"`
 	NAT       NATConfig       `json:"nat"`
+	Push      PushConfig      `json:"push"`
 }
 
 func Load(path string) (*Config, error) {
@@ -58,9 +174,32 @@ func Load(path string) (*Config, error) {
 		Auth: AuthConfig{
 			Header: "X-API-Key",
 		},
+		DNS: DNSConfig{
+			MinTTLSeconds:              60,
+			MaxTTLSeconds:              3600,
+			BatchWindowMillis:          10,
+			HealthCheckIntervalSeconds: 30,
+			CacheSize:                  10000,
+			ServeStaleSeconds:          86400,
+			Prefetch:                   true,
+		},
+		Gateway: GatewayConfig{
+			RestoreOnStart:           true,
+			ReconcileIntervalSeconds: 60,
+			TableIDMin:               101,
+			TableIDMax:               250,
+			FwmarkMin:                101,
+			FwmarkMax:                250,
+		},
 		WireGuard: WireGuardConfig{
 			Interface: "wg0",
 		},
+		Push: PushConfig{
+			GatewayHeader:        "X-API-Key",
+			TimeoutSeconds:       30,
+			MaxAttempts:          3,
+			RetryIntervalSeconds: 60,
+		},
 	}
 
 	if path == "" {
@@ -79,6 +218,9 @@ func Load(path string) (*Config, error) {
 	if cfg.Auth.Header == "" {
 		cfg.Auth.Header = "X-API-Key"
 	}
+	if err := cfg.Auth.Validate(); err != nil {
+		return nil, fmt.Errorf("auth: %w", err)
+	}
 	if cfg.WireGuard.Interface == "" {
 		cfg.WireGuard.Interface = "wg0"
 	}
@@ -0,0 +1,160 @@
+package controllerdb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Audit actions.
+const (
+	AuditCreate  = "create"
+	AuditUpdate  = "update"
+	AuditDelete  = "delete"
+	AuditPublish = "publish"
+	AuditDiscard = "discard"
+	AuditRestore = "restore"
+)
+
+// Audited resource types.
+const (
+	ResourceNode     = "node"
+	ResourcePolicy   = "policy"
+	ResourceRoute    = "route"
+	ResourceZone     = "zone"
+	ResourceRevision = "revision"
+)
+
+// SystemActor is recorded for writes made without an authenticated caller.
+const SystemActor = "system"
+
+// AuditEntry is one row of the append-only audit log. Before is empty for
+// creates and After is empty for deletes.
+type AuditEntry struct {
+	ID         int64           `json:"id"`
+	At         time.Time       `json:"at"`
+	Actor      string          `json:"actor"`
+	Action     string          `json:"action"`
+	Resource   string          `json:"resource"`
+	ResourceID int64           `json:"resourceId"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+}
+
+// AuditFilter narrows ListAudit. Zero values match everything.
+type AuditFilter struct {
+	Resource   string
+	ResourceID int64
+	Actor      string
+	Since      time.Time
+	Until      time.Time
+	Limit      int
+}
+
+type actorKey struct{}
+
+// WithActor attributes store writes made with ctx to actor.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+func actorFrom(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	return SystemActor
+}
+
+func recordAudit(ctx context.Context, tx *sql.Tx, action, resource string, id int64, before, after any) error {
+	beforeJSON, err := auditJSON(before)
+	if err != nil {
+		return err
+	}
+	afterJSON, err := auditJSON(after)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+        INSERT INTO audit_log (at, actor, action, resource, resource_id, before, after)
+        VALUES (?, ?, ?, ?, ?, ?, ?)
+    `, time.Now().UTC(), actorFrom(ctx), action, resource, id, beforeJSON, afterJSON)
+	if err != nil {
+		return fmt.Errorf("record audit: %w", err)
+	}
+	return nil
+}
+
+func auditJSON(v any) (sql.NullString, error) {
+	if v == nil {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return sql.NullString{}, fmt.Errorf("marshal audit payload: %w", err)
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+// ListAudit returns matching audit entries, newest first.
+func (s *Store) ListAudit(ctx context.Context, f AuditFilter) ([]AuditEntry, error) {
+	var (
+		where []string
+		args  []any
+	)
+	if f.Resource != "" {
+		where = append(where, "resource = ?")
+		args = append(args, f.Resource)
+	}
+	if f.ResourceID != 0 {
+		where = append(where, "resource_id = ?")
+		args = append(args, f.ResourceID)
+	}
+	if f.Actor != "" {
+		where = append(where, "actor = ?")
+		args = append(args, f.Actor)
+	}
+	if !f.Since.IsZero() {
+		where = append(where, "at >= ?")
+		args = append(args, f.Since.UTC())
+	}
+	if !f.Until.IsZero() {
+		where = append(where, "at < ?")
+		args = append(args, f.Until.UTC())
+	}
+	query := `SELECT id, at, actor, action, resource, resource_id, before, after FROM audit_log`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC"
+	if f.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, f.Limit)
+	}
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var (
+			e             AuditEntry
+			before, after sql.NullString
+		)
+		if err := rows.Scan(&e.ID, &e.At, &e.Actor, &e.Action, &e.Resource, &e.ResourceID, &before, &after); err != nil {
+			return nil, err
+		}
+		if before.Valid {
+			e.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			e.After = json.RawMessage(after.String)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
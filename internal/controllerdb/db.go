@@ -3,21 +3,51 @@ package controllerdb
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
+
+	"octaroute/internal/migrate"
+)
+
+var (
+	// ErrNotFound is returned when a resource with the requested ID does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrInvalidReference is returned when a write names a related resource
+	// that does not exist.
+	ErrInvalidReference = errors.New("referenced resource does not exist")
+	// ErrDuplicate is returned when a write collides with a unique constraint.
+	ErrDuplicate = errors.New("resource already exists")
 )
 
 type Store struct {
 	db *sql.DB
 }
 
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// Node roles. Gateways receive compiled policies from the controller, exits
+// are the WireGuard peers that gateways egress through.
+const (
+	RoleGateway = "gateway"
+	RoleExit    = "exit"
+)
+
 type Node struct {
 	ID        int64     `json:"id"`
 	Name      string    `json:"name"`
 	Address   string    `json:"address"`
 	Zone      string    `json:"zone"`
+	Role      string    `json:"role"`
+	Endpoint  string    `json:"endpoint"`
+	PublicKey string    `json:"publicKey"`
+	APIURL    string    `json:"apiUrl"`
 	CreatedAt time.Time `json:"createdAt"`
 }
 
@@ -38,8 +68,20 @@ type Route struct {
 	CreatedAt time.Time `json:"createdAt"`
 }
 
+// PushStatus records the outcome of the latest push to a gateway node.
+type PushStatus struct {
+	NodeID    int64     `json:"nodeId"`
+	NodeName  string    `json:"nodeName"`
+	Success   bool      `json:"success"`
+	Error     string    `json:"error,omitempty"`
+	Skipped   []string  `json:"skipped,omitempty"`
+	Attempts  int       `json:"attempts"`
+	PushedAt  time.Time `json:"pushedAt"`
+	AppliedAt time.Time `json:"appliedAt,omitempty"`
+}
+
 func Open(path string) (*Store, error) {
-	db, err := sql.Open("sqlite3", path)
+	db, err := sql.Open("sqlite3", withForeignKeys(path))
 	if err != nil {
 		return nil, fmt.Errorf("open database: %w", err)
 	}
@@ -51,45 +93,34 @@ func Open(path string) (*Store, error) {
 	return store, nil
 }
 
+// withForeignKeys enables foreign key enforcement on every pooled connection,
+// which a one-off PRAGMA in migrate cannot do.
+func withForeignKeys(path string) string {
+	if strings.Contains(path, "_foreign_keys") || strings.Contains(path, "_fk=") {
+		return path
+	}
+	if strings.Contains(path, "?") {
+		return path + "&_foreign_keys=on"
+	}
+	return path + "?_foreign_keys=on"
+}
+
 func (s *Store) Close() error {
 	return s.db.Close()
 }
 
 func (s *Store) migrate(ctx context.Context) error {
-	schema := `
-    PRAGMA foreign_keys = ON;
-    CREATE TABLE IF NOT EXISTS nodes (
-        id INTEGER PRIMARY KEY AUTOINCREMENT,
-        name TEXT NOT NULL,
-        address TEXT NOT NULL,
-        zone TEXT NOT NULL,
-        created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
-    );
-    CREATE TABLE IF NOT EXISTS policies (
-        id INTEGER PRIMARY KEY AUTOINCREMENT,
-        name TEXT NOT NULL,
-        source TEXT NOT NULL,
-        destination TEXT NOT NULL,
-        action TEXT NOT NULL,
-        created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
-    );
-    CREATE TABLE IF NOT EXISTS routes (
-        id INTEGER PRIMARY KEY AUTOINCREMENT,
-        cidr TEXT NOT NULL,
-        next_hop TEXT NOT NULL,
-        node_id INTEGER NOT NULL,
-        created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
-        FOREIGN KEY(node_id) REFERENCES nodes(id) ON DELETE CASCADE
-    );
-    `
-	if _, err := s.db.ExecContext(ctx, schema); err != nil {
-		return fmt.Errorf("apply schema: %w", err)
-	}
-	return nil
+	_, err := migrate.Apply(ctx, s.db, migrations)
+	return err
+}
+
+// SchemaVersion reports the schema migration the database is at.
+func (s *Store) SchemaVersion(ctx context.Context) (int, error) {
+	return migrate.Version(ctx, s.db)
 }
 
 func (s *Store) ListNodes(ctx context.Context) ([]Node, error) {
-	rows, err := s.db.QueryContext(ctx, `SELECT id, name, address, zone, created_at FROM nodes ORDER BY id`)
+	rows, err := s.db.QueryContext(ctx, `SELECT `+nodeColumns+` FROM nodes ORDER BY id`)
 	if err != nil {
 		return nil, err
 	}
@@ -97,8 +128,8 @@ func (s *Store) ListNodes(ctx context.Context) ([]Node, error) {
 
 	var nodes []Node
 	for rows.Next() {
-		var n Node
-		if err := rows.Scan(&n.ID, &n.Name, &n.Address, &n.Zone, &n.CreatedAt); err != nil {
+		n, err := scanNode(rows)
+		if err != nil {
 			return nil, err
 		}
 		nodes = append(nodes, n)
@@ -106,21 +137,162 @@ func (s *Store) ListNodes(ctx context.Context) ([]Node, error) {
 	return nodes, rows.Err()
 }
 
-func (s *Store) CreateNode(ctx context.Context, n Node) (Node, error) {
-	res, err := s.db.ExecContext(ctx, `INSERT INTO nodes (name, address, zone) VALUES (?, ?, ?)`, n.Name, n.Address, n.Zone)
-	if err != nil {
-		return Node{}, err
+const nodeColumns = `id, name, address, zone, role, endpoint, public_key, api_url, created_at`
+
+func scanNode(row rowScanner) (Node, error) {
+	var n Node
+	err := row.Scan(&n.ID, &n.Name, &n.Address, &n.Zone, &n.Role, &n.Endpoint, &n.PublicKey, &n.APIURL, &n.CreatedAt)
+	return n, err
+}
+
+func (s *Store) GetNode(ctx context.Context, id int64) (Node, error) {
+	return getNode(ctx, s.db, id)
+}
+
+func getNode(ctx context.Context, q rowQueryer, id int64) (Node, error) {
+	n, err := scanNode(q.QueryRowContext(ctx, `SELECT `+nodeColumns+` FROM nodes WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Node{}, ErrNotFound
 	}
-	id, err := res.LastInsertId()
+	return n, err
+}
+
+func (s *Store) UpdateNode(ctx context.Context, n Node) (Node, error) {
+	if n.Role == "" {
+		n.Role = RoleExit
+	}
+	var updated Node
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		before, err := getNode(ctx, tx, n.ID)
+		if err != nil {
+			return err
+		}
+		zid, err := zoneID(ctx, tx, n.Zone)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE nodes SET name = ?, address = ?, zone = ?, zone_id = ?, role = ?, endpoint = ?, public_key = ?, api_url = ? WHERE id = ?`,
+			n.Name, n.Address, n.Zone, zid, n.Role, n.Endpoint, n.PublicKey, n.APIURL, n.ID)
+		if err != nil {
+			return translateError(err)
+		}
+		if updated, err = getNode(ctx, tx, n.ID); err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, AuditUpdate, ResourceNode, n.ID, before, updated)
+	})
+	return updated, err
+}
+
+// NodeDeletion reports a deleted node and the routes removed with it by the
+// routes.node_id ON DELETE CASCADE.
+type NodeDeletion struct {
+	Node           Node    `json:"node"`
+	CascadedRoutes []Route `json:"cascadedRoutes"`
+}
+
+func (s *Store) DeleteNode(ctx context.Context, id int64) (NodeDeletion, error) {
+	var deletion NodeDeletion
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		n, err := getNode(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		routes, err := queryRoutes(ctx, tx, `SELECT `+routeColumns+` FROM routes WHERE node_id = ? ORDER BY id`, id)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM nodes WHERE id = ?`, id); err != nil {
+			return translateError(err)
+		}
+		var remaining int
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM routes WHERE node_id = ?`, id).Scan(&remaining); err != nil {
+			return err
+		}
+		if remaining != 0 {
+			return fmt.Errorf("delete node %d: %d routes were not cascaded", id, remaining)
+		}
+		if err := recordAudit(ctx, tx, AuditDelete, ResourceNode, id, n, nil); err != nil {
+			return err
+		}
+		for _, r := range routes {
+			if err := recordAudit(ctx, tx, AuditDelete, ResourceRoute, r.ID, r, nil); err != nil {
+				return err
+			}
+		}
+		if routes == nil {
+			routes = []Route{}
+		}
+		deletion = NodeDeletion{Node: n, CascadedRoutes: routes}
+		return nil
+	})
+	return deletion, err
+}
+
+// withTx runs fn in a transaction that is committed only if fn succeeds.
+func (s *Store) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return Node{}, err
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// translateError maps constraint violations onto ErrInvalidReference and
+// ErrDuplicate.
+func translateError(err error) error {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return err
+	}
+	switch sqliteErr.ExtendedCode {
+	case sqlite3.ErrConstraintForeignKey:
+		return fmt.Errorf("%w: %v", ErrInvalidReference, err)
+	case sqlite3.ErrConstraintUnique, sqlite3.ErrConstraintPrimaryKey:
+		return fmt.Errorf("%w: %v", ErrDuplicate, err)
+	}
+	return err
+}
+
+func (s *Store) CreateNode(ctx context.Context, n Node) (Node, error) {
+	if n.Role == "" {
+		n.Role = RoleExit
 	}
-	n.ID = id
-	return n, nil
+	var created Node
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		zid, err := zoneID(ctx, tx, n.Zone)
+		if err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, `INSERT INTO nodes (name, address, zone, zone_id, role, endpoint, public_key, api_url) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			n.Name, n.Address, n.Zone, zid, n.Role, n.Endpoint, n.PublicKey, n.APIURL)
+		if err != nil {
+			return translateError(err)
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		if created, err = getNode(ctx, tx, id); err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, AuditCreate, ResourceNode, id, nil, created)
+	})
+	return created, err
 }
 
+// ListPolicies returns the draft policies. Gateways receive the policies of
+// the published revision instead; see PublishedRevision.
 func (s *Store) ListPolicies(ctx context.Context) ([]Policy, error) {
-	rows, err := s.db.QueryContext(ctx, `SELECT id, name, source, destination, action, created_at FROM policies ORDER BY id`)
+	return queryPolicies(ctx, s.db)
+}
+
+func queryPolicies(ctx context.Context, q queryer) ([]Policy, error) {
+	rows, err := q.QueryContext(ctx, `SELECT `+policyColumns+` FROM policies ORDER BY id`)
 	if err != nil {
 		return nil, err
 	}
@@ -128,8 +300,8 @@ func (s *Store) ListPolicies(ctx context.Context) ([]Policy, error) {
 
 	var policies []Policy
 	for rows.Next() {
-		var p Policy
-		if err := rows.Scan(&p.ID, &p.Name, &p.Source, &p.Destination, &p.Action, &p.CreatedAt); err != nil {
+		p, err := scanPolicy(rows)
+		if err != nil {
 			return nil, err
 		}
 		policies = append(policies, p)
@@ -137,21 +309,118 @@ func (s *Store) ListPolicies(ctx context.Context) ([]Policy, error) {
 	return policies, rows.Err()
 }
 
-func (s *Store) CreatePolicy(ctx context.Context, p Policy) (Policy, error) {
-	res, err := s.db.ExecContext(ctx, `INSERT INTO policies (name, source, destination, action) VALUES (?, ?, ?, ?)`, p.Name, p.Source, p.Destination, p.Action)
+const policyColumns = `id, name, source, destination, action, created_at`
+
+func scanPolicy(row rowScanner) (Policy, error) {
+	var p Policy
+	err := row.Scan(&p.ID, &p.Name, &p.Source, &p.Destination, &p.Action, &p.CreatedAt)
+	return p, err
+}
+
+func (s *Store) GetPolicy(ctx context.Context, id int64) (Policy, error) {
+	return getPolicy(ctx, s.db, id)
+}
+
+func getPolicy(ctx context.Context, q rowQueryer, id int64) (Policy, error) {
+	p, err := scanPolicy(q.QueryRowContext(ctx, `SELECT `+policyColumns+` FROM policies WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Policy{}, ErrNotFound
+	}
+	return p, err
+}
+
+func (s *Store) UpdatePolicy(ctx context.Context, p Policy) (Policy, error) {
+	var updated Policy
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		before, err := getPolicy(ctx, tx, p.ID)
+		if err != nil {
+			return err
+		}
+		sourceID, destinationID, err := policyZoneIDs(ctx, tx, p)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE policies SET name = ?, source = ?, source_zone_id = ?, destination = ?, destination_zone_id = ?, action = ? WHERE id = ?`,
+			p.Name, p.Source, sourceID, p.Destination, destinationID, p.Action, p.ID)
+		if err != nil {
+			return translateError(err)
+		}
+		if updated, err = getPolicy(ctx, tx, p.ID); err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, AuditUpdate, ResourcePolicy, p.ID, before, updated)
+	})
+	return updated, err
+}
+
+func policyZoneIDs(ctx context.Context, q rowQueryer, p Policy) (int64, int64, error) {
+	sourceID, err := zoneID(ctx, q, p.Source)
 	if err != nil {
-		return Policy{}, err
+		return 0, 0, err
 	}
-	id, err := res.LastInsertId()
+	destinationID, err := zoneID(ctx, q, p.Destination)
 	if err != nil {
-		return Policy{}, err
+		return 0, 0, err
 	}
-	p.ID = id
-	return p, nil
+	return sourceID, destinationID, nil
+}
+
+func (s *Store) DeletePolicy(ctx context.Context, id int64) (Policy, error) {
+	var deleted Policy
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		if deleted, err = getPolicy(ctx, tx, id); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM policies WHERE id = ?`, id); err != nil {
+			return translateError(err)
+		}
+		return recordAudit(ctx, tx, AuditDelete, ResourcePolicy, id, deleted, nil)
+	})
+	return deleted, err
+}
+
+func (s *Store) CreatePolicy(ctx context.Context, p Policy) (Policy, error) {
+	var created Policy
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		sourceID, destinationID, err := policyZoneIDs(ctx, tx, p)
+		if err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, `INSERT INTO policies (name, source, source_zone_id, destination, destination_zone_id, action) VALUES (?, ?, ?, ?, ?, ?)`,
+			p.Name, p.Source, sourceID, p.Destination, destinationID, p.Action)
+		if err != nil {
+			return translateError(err)
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		if created, err = getPolicy(ctx, tx, id); err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, AuditCreate, ResourcePolicy, id, nil, created)
+	})
+	return created, err
 }
 
 func (s *Store) ListRoutes(ctx context.Context) ([]Route, error) {
-	rows, err := s.db.QueryContext(ctx, `SELECT id, cidr, next_hop, node_id, created_at FROM routes ORDER BY id`)
+	return queryRoutes(ctx, s.db, `SELECT `+routeColumns+` FROM routes ORDER BY id`)
+}
+
+const routeColumns = `id, cidr, next_hop, node_id, created_at`
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+type dbQueryer interface {
+	queryer
+	rowQueryer
+}
+
+func queryRoutes(ctx context.Context, q queryer, query string, args ...any) ([]Route, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -159,8 +428,8 @@ func (s *Store) ListRoutes(ctx context.Context) ([]Route, error) {
 
 	var routes []Route
 	for rows.Next() {
-		var r Route
-		if err := rows.Scan(&r.ID, &r.CIDR, &r.NextHop, &r.NodeID, &r.CreatedAt); err != nil {
+		r, err := scanRoute(rows)
+		if err != nil {
 			return nil, err
 		}
 		routes = append(routes, r)
@@ -168,15 +437,131 @@ func (s *Store) ListRoutes(ctx context.Context) ([]Route, error) {
 	return routes, rows.Err()
 }
 
+func scanRoute(row rowScanner) (Route, error) {
+	var r Route
+	err := row.Scan(&r.ID, &r.CIDR, &r.NextHop, &r.NodeID, &r.CreatedAt)
+	return r, err
+}
+
+func (s *Store) GetRoute(ctx context.Context, id int64) (Route, error) {
+	return getRoute(ctx, s.db, id)
+}
+
+func getRoute(ctx context.Context, q rowQueryer, id int64) (Route, error) {
+	r, err := scanRoute(q.QueryRowContext(ctx, `SELECT `+routeColumns+` FROM routes WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Route{}, ErrNotFound
+	}
+	return r, err
+}
+
+func (s *Store) UpdateRoute(ctx context.Context, r Route) (Route, error) {
+	var updated Route
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		before, err := getRoute(ctx, tx, r.ID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE routes SET cidr = ?, next_hop = ?, node_id = ? WHERE id = ?`,
+			r.CIDR, r.NextHop, r.NodeID, r.ID)
+		if err != nil {
+			return translateError(err)
+		}
+		if updated, err = getRoute(ctx, tx, r.ID); err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, AuditUpdate, ResourceRoute, r.ID, before, updated)
+	})
+	return updated, err
+}
+
+func (s *Store) DeleteRoute(ctx context.Context, id int64) (Route, error) {
+	var deleted Route
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		if deleted, err = getRoute(ctx, tx, id); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM routes WHERE id = ?`, id); err != nil {
+			return translateError(err)
+		}
+		return recordAudit(ctx, tx, AuditDelete, ResourceRoute, id, deleted, nil)
+	})
+	return deleted, err
+}
+
 func (s *Store) CreateRoute(ctx context.Context, r Route) (Route, error) {
-	res, err := s.db.ExecContext(ctx, `INSERT INTO routes (cidr, next_hop, node_id) VALUES (?, ?, ?)`, r.CIDR, r.NextHop, r.NodeID)
+	var created Route
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `INSERT INTO routes (cidr, next_hop, node_id) VALUES (?, ?, ?)`, r.CIDR, r.NextHop, r.NodeID)
+		if err != nil {
+			return translateError(err)
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		if created, err = getRoute(ctx, tx, id); err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, AuditCreate, ResourceRoute, id, nil, created)
+	})
+	return created, err
+}
+
+func (s *Store) ListPushStatus(ctx context.Context) ([]PushStatus, error) {
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT p.node_id, n.name, p.success, p.error, p.skipped, p.attempts, p.pushed_at, p.applied_at
+        FROM push_status p JOIN nodes n ON n.id = p.node_id
+        ORDER BY p.node_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var statuses []PushStatus
+	for rows.Next() {
+		var (
+			ps        PushStatus
+			skipped   string
+			appliedAt sql.NullTime
+		)
+		if err := rows.Scan(&ps.NodeID, &ps.NodeName, &ps.Success, &ps.Error, &skipped, &ps.Attempts, &ps.PushedAt, &appliedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(skipped), &ps.Skipped); err != nil {
+			return nil, fmt.Errorf("decode skipped policies for node %d: %w", ps.NodeID, err)
+		}
+		if appliedAt.Valid {
+			ps.AppliedAt = appliedAt.Time
+		}
+		statuses = append(statuses, ps)
+	}
+	return statuses, rows.Err()
+}
+
+func (s *Store) RecordPush(ctx context.Context, ps PushStatus) error {
+	var appliedAt any
+	if !ps.AppliedAt.IsZero() {
+		appliedAt = ps.AppliedAt
+	}
+	skipped, err := json.Marshal(ps.Skipped)
 	if err != nil {
-		return Route{}, err
+		return fmt.Errorf("encode skipped policies for node %d: %w", ps.NodeID, err)
 	}
-	id, err := res.LastInsertId()
+	_, err = s.db.ExecContext(ctx, `
+        INSERT INTO push_status (node_id, success, error, skipped, attempts, pushed_at, applied_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT(node_id) DO UPDATE SET
+            success = excluded.success,
+            error = excluded.error,
+            skipped = excluded.skipped,
+            attempts = excluded.attempts,
+            pushed_at = excluded.pushed_at,
+            applied_at = COALESCE(excluded.applied_at, push_status.applied_at)
+    `, ps.NodeID, ps.Success, ps.Error, string(skipped), ps.Attempts, ps.PushedAt, appliedAt)
 	if err != nil {
-		return Route{}, err
+		return fmt.Errorf("record push for node %d: %w", ps.NodeID, err)
 	}
-	r.ID = id
-	return r, nil
+	return nil
 }
@@ -0,0 +1,180 @@
+package controllerdb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"octaroute/internal/migrate"
+)
+
+// migrations is the ordered controller schema history. Append new entries;
+// never edit one that has shipped.
+var migrations = []migrate.Migration{
+	{Version: 1, Name: "initial schema", Up: migrate.Exec(`
+    CREATE TABLE IF NOT EXISTS nodes (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        name TEXT NOT NULL,
+        address TEXT NOT NULL,
+        zone TEXT NOT NULL,
+        created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+    );
+    CREATE TABLE IF NOT EXISTS policies (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        name TEXT NOT NULL,
+        source TEXT NOT NULL,
+        destination TEXT NOT NULL,
+        action TEXT NOT NULL,
+        created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+    );
+    CREATE TABLE IF NOT EXISTS routes (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        cidr TEXT NOT NULL,
+        next_hop TEXT NOT NULL,
+        node_id INTEGER NOT NULL,
+        created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        FOREIGN KEY(node_id) REFERENCES nodes(id) ON DELETE CASCADE
+    );
+    `)},
+	{Version: 2, Name: "node roles and push status", Up: migrateNodeRoles},
+	{Version: 3, Name: "zones", Up: migrateZones},
+	{Version: 4, Name: "audit log", Up: migrate.Exec(`
+    CREATE TABLE audit_log (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        at DATETIME NOT NULL,
+        actor TEXT NOT NULL,
+        action TEXT NOT NULL,
+        resource TEXT NOT NULL,
+        resource_id INTEGER NOT NULL,
+        before TEXT,
+        after TEXT
+    );
+    CREATE INDEX audit_log_resource ON audit_log (resource, resource_id);
+    CREATE INDEX audit_log_at ON audit_log (at);
+    CREATE TRIGGER audit_log_no_update BEFORE UPDATE ON audit_log
+    BEGIN
+        SELECT RAISE(ABORT, 'audit_log is append-only');
+    END;
+    CREATE TRIGGER audit_log_no_delete BEFORE DELETE ON audit_log
+    BEGIN
+        SELECT RAISE(ABORT, 'audit_log is append-only');
+    END;
+    `)},
+	{Version: 5, Name: "policy revisions", Up: migratePolicyRevisions},
+}
+
+func migrateNodeRoles(ctx context.Context, tx *sql.Tx) error {
+	columns := []struct{ name, definition string }{
+		{"role", "TEXT NOT NULL DEFAULT 'exit'"},
+		{"endpoint", "TEXT NOT NULL DEFAULT ''"},
+		{"public_key", "TEXT NOT NULL DEFAULT ''"},
+		{"api_url", "TEXT NOT NULL DEFAULT ''"},
+	}
+	for _, col := range columns {
+		if err := migrate.AddColumn(ctx, tx, "nodes", col.name, col.definition); err != nil {
+			return err
+		}
+	}
+	_, err := tx.ExecContext(ctx, `
+    CREATE TABLE IF NOT EXISTS push_status (
+        node_id INTEGER PRIMARY KEY,
+        success INTEGER NOT NULL,
+        error TEXT NOT NULL DEFAULT '',
+        skipped TEXT NOT NULL DEFAULT '[]',
+        attempts INTEGER NOT NULL,
+        pushed_at DATETIME NOT NULL,
+        applied_at DATETIME,
+        FOREIGN KEY(node_id) REFERENCES nodes(id) ON DELETE CASCADE
+    );
+    `)
+	return err
+}
+
+func migrateZones(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+    CREATE TABLE IF NOT EXISTS zones (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        name TEXT NOT NULL UNIQUE,
+        description TEXT NOT NULL DEFAULT '',
+        created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+    );
+    CREATE TABLE IF NOT EXISTS zone_cidrs (
+        zone_id INTEGER NOT NULL,
+        cidr TEXT NOT NULL,
+        PRIMARY KEY(zone_id, cidr),
+        FOREIGN KEY(zone_id) REFERENCES zones(id) ON DELETE CASCADE
+    );
+    `)
+	if err != nil {
+		return err
+	}
+	columns := []struct{ table, name string }{
+		{"nodes", "zone_id"},
+		{"policies", "source_zone_id"},
+		{"policies", "destination_zone_id"},
+	}
+	for _, col := range columns {
+		if err := migrate.AddColumn(ctx, tx, col.table, col.name, "INTEGER REFERENCES zones(id)"); err != nil {
+			return err
+		}
+	}
+	// Backfill zones from the free-text columns they replace.
+	_, err = tx.ExecContext(ctx, `
+    INSERT OR IGNORE INTO zones (name)
+        SELECT zone FROM nodes WHERE zone_id IS NULL
+        UNION SELECT source FROM policies WHERE source_zone_id IS NULL
+        UNION SELECT destination FROM policies WHERE destination_zone_id IS NULL;
+    UPDATE nodes SET zone_id = (SELECT id FROM zones WHERE zones.name = nodes.zone) WHERE zone_id IS NULL;
+    UPDATE policies SET source_zone_id = (SELECT id FROM zones WHERE zones.name = policies.source) WHERE source_zone_id IS NULL;
+    UPDATE policies SET destination_zone_id = (SELECT id FROM zones WHERE zones.name = policies.destination) WHERE destination_zone_id IS NULL;
+    `)
+	return err
+}
+
+// migratePolicyRevisions adds published revisions. Policies already in the
+// database were live before drafts existed, so they become revision 1.
+func migratePolicyRevisions(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+    CREATE TABLE policy_revisions (
+        number INTEGER PRIMARY KEY AUTOINCREMENT,
+        published_at DATETIME NOT NULL,
+        actor TEXT NOT NULL,
+        message TEXT NOT NULL DEFAULT '',
+        restored_from INTEGER REFERENCES policy_revisions(number),
+        payload TEXT NOT NULL
+    );
+    `)
+	if err != nil {
+		return err
+	}
+	// Read the columns as they were at this version, not policyColumns,
+	// which later migrations extend.
+	rows, err := tx.QueryContext(ctx, `SELECT id, name, source, destination, action, created_at FROM policies ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	var policies []Policy
+	for rows.Next() {
+		var p Policy
+		if err := rows.Scan(&p.ID, &p.Name, &p.Source, &p.Destination, &p.Action, &p.CreatedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		policies = append(policies, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(policies) == 0 {
+		return nil
+	}
+	payload, err := json.Marshal(policies)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO policy_revisions (published_at, actor, message, payload) VALUES (?, ?, ?, ?)`,
+		time.Now().UTC(), SystemActor, "policies live before draft workflow", string(payload))
+	return err
+}
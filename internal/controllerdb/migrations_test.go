@@ -0,0 +1,132 @@
+package controllerdb_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"octaroute/internal/controllerdb"
+)
+
+// baselineSchema is the unversioned schema the controller created before
+// migrations existed.
+const baselineSchema = `
+CREATE TABLE nodes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL,
+    address TEXT NOT NULL,
+    zone TEXT NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE policies (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL,
+    source TEXT NOT NULL,
+    destination TEXT NOT NULL,
+    action TEXT NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE routes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    cidr TEXT NOT NULL,
+    next_hop TEXT NOT NULL,
+    node_id INTEGER NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(node_id) REFERENCES nodes(id) ON DELETE CASCADE
+);
+INSERT INTO nodes (name, address, zone) VALUES ('london', '10.42.0.3', 'uk'), ('leeds', '10.42.0.4', 'uk');
+INSERT INTO policies (name, source, destination, action) VALUES ('office-uk', 'office', 'uk', 'allow');
+INSERT INTO routes (cidr, next_hop, node_id) VALUES ('192.168.10.0/24', '10.42.0.1', 1);
+`
+
+func TestMigrateBaselineDatabase(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "controller.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(baselineSchema); err != nil {
+		t.Fatal(err)
+	}
+	_ = db.Close()
+
+	store, err := controllerdb.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if v, err := store.SchemaVersion(ctx); err != nil || v != 5 {
+		t.Fatalf("SchemaVersion = %d, %v; want 5", v, err)
+	}
+	zones, err := store.ListZones(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	members := make(map[string][]string)
+	for _, z := range zones {
+		members[z.Name] = z.Nodes
+	}
+	if len(zones) != 2 || len(members["office"]) != 0 || len(members["uk"]) != 2 {
+		t.Fatalf("zones after backfill = %+v", zones)
+	}
+	nodes, err := store.ListNodes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 || nodes[0].Name != "london" || nodes[0].Zone != "uk" || nodes[0].Role != controllerdb.RoleExit {
+		t.Fatalf("nodes after migration = %+v", nodes)
+	}
+	routes, err := store.ListRoutes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 1 || routes[0].NodeID != nodes[0].ID {
+		t.Fatalf("routes after migration = %+v", routes)
+	}
+	published, err := store.PublishedRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if published.Number != 1 || len(published.Policies) != 1 || published.Policies[0].Name != "office-uk" {
+		t.Fatalf("published revision after migration = %+v", published)
+	}
+	cs, err := store.Changeset(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cs.Empty() {
+		t.Errorf("draft differs from migrated revision: %+v", cs)
+	}
+	// Renaming a backfilled zone must reach the migrated policy.
+	for _, z := range zones {
+		if z.Name == "office" {
+			z.Name = "hq"
+			if _, err := store.UpdateZone(ctx, z); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	policies, err := store.ListPolicies(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policies[0].Source != "hq" {
+		t.Errorf("policy source after rename = %q, want hq", policies[0].Source)
+	}
+
+	// Reopening runs no migrations and keeps the data.
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := controllerdb.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if nodes, err := reopened.ListNodes(ctx); err != nil || len(nodes) != 2 {
+		t.Fatalf("nodes after reopening = %+v, %v", nodes, err)
+	}
+}
@@ -0,0 +1,336 @@
+package controllerdb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// ErrNoChanges is returned when publishing a draft identical to the
+// published revision.
+var ErrNoChanges = errors.New("draft has no changes to publish")
+
+// Revision is a published, immutable snapshot of the policy set. The
+// policies table holds the draft that the next publish turns into a
+// revision; gateways only ever receive published revisions.
+type Revision struct {
+	Number       int64     `json:"number"`
+	PublishedAt  time.Time `json:"publishedAt"`
+	Actor        string    `json:"actor"`
+	Message      string    `json:"message"`
+	RestoredFrom int64     `json:"restoredFrom,omitempty"`
+	Policies     []Policy  `json:"policies,omitempty"`
+}
+
+// PolicyChange is a policy whose draft differs from the published revision.
+type PolicyChange struct {
+	Before Policy `json:"before"`
+	After  Policy `json:"after"`
+}
+
+// Changeset is the difference between the draft policies and the latest
+// published revision.
+type Changeset struct {
+	BaseRevision int64          `json:"baseRevision"`
+	Added        []Policy       `json:"added"`
+	Removed      []Policy       `json:"removed"`
+	Changed      []PolicyChange `json:"changed"`
+}
+
+// Empty reports whether the draft matches the published revision.
+func (c Changeset) Empty() bool {
+	return len(c.Added) == 0 && len(c.Removed) == 0 && len(c.Changed) == 0
+}
+
+// ListRevisions returns revision metadata, newest first, without policies.
+func (s *Store) ListRevisions(ctx context.Context) ([]Revision, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT number, published_at, actor, message, restored_from FROM policy_revisions ORDER BY number DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []Revision{}
+	for rows.Next() {
+		var (
+			rev          Revision
+			restoredFrom sql.NullInt64
+		)
+		if err := rows.Scan(&rev.Number, &rev.PublishedAt, &rev.Actor, &rev.Message, &restoredFrom); err != nil {
+			return nil, err
+		}
+		rev.RestoredFrom = restoredFrom.Int64
+		revisions = append(revisions, rev)
+	}
+	return revisions, rows.Err()
+}
+
+func (s *Store) GetRevision(ctx context.Context, number int64) (Revision, error) {
+	return getRevision(ctx, s.db, number)
+}
+
+func getRevision(ctx context.Context, q rowQueryer, number int64) (Revision, error) {
+	var (
+		rev          Revision
+		restoredFrom sql.NullInt64
+		payload      string
+	)
+	err := q.QueryRowContext(ctx, `SELECT number, published_at, actor, message, restored_from, payload FROM policy_revisions WHERE number = ?`, number).
+		Scan(&rev.Number, &rev.PublishedAt, &rev.Actor, &rev.Message, &restoredFrom, &payload)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Revision{}, ErrNotFound
+	}
+	if err != nil {
+		return Revision{}, err
+	}
+	rev.RestoredFrom = restoredFrom.Int64
+	if err := json.Unmarshal([]byte(payload), &rev.Policies); err != nil {
+		return Revision{}, fmt.Errorf("decode revision %d: %w", number, err)
+	}
+	if rev.Policies == nil {
+		rev.Policies = []Policy{}
+	}
+	return rev, nil
+}
+
+// PublishedRevision returns the latest published revision. A store that has
+// never published returns revision 0 with no policies.
+func (s *Store) PublishedRevision(ctx context.Context) (Revision, error) {
+	return publishedRevision(ctx, s.db)
+}
+
+func publishedRevision(ctx context.Context, q rowQueryer) (Revision, error) {
+	var number sql.NullInt64
+	if err := q.QueryRowContext(ctx, `SELECT MAX(number) FROM policy_revisions`).Scan(&number); err != nil {
+		return Revision{}, err
+	}
+	if !number.Valid {
+		return Revision{Policies: []Policy{}}, nil
+	}
+	return getRevision(ctx, q, number.Int64)
+}
+
+// Changeset diffs the draft policies against the published revision.
+func (s *Store) Changeset(ctx context.Context) (Changeset, error) {
+	return changeset(ctx, s.db)
+}
+
+func changeset(ctx context.Context, q dbQueryer) (Changeset, error) {
+	published, err := publishedRevision(ctx, q)
+	if err != nil {
+		return Changeset{}, err
+	}
+	draft, err := queryPolicies(ctx, q)
+	if err != nil {
+		return Changeset{}, err
+	}
+	return diffPolicies(published.Number, published.Policies, draft), nil
+}
+
+func diffPolicies(base int64, published, draft []Policy) Changeset {
+	cs := Changeset{
+		BaseRevision: base,
+		Added:        []Policy{},
+		Removed:      []Policy{},
+		Changed:      []PolicyChange{},
+	}
+	before := make(map[int64]Policy, len(published))
+	for _, p := range published {
+		before[p.ID] = p
+	}
+	for _, p := range draft {
+		old, ok := before[p.ID]
+		delete(before, p.ID)
+		switch {
+		case !ok:
+			cs.Added = append(cs.Added, p)
+		case !samePolicy(old, p):
+			cs.Changed = append(cs.Changed, PolicyChange{Before: old, After: p})
+		}
+	}
+	for _, p := range published {
+		if _, ok := before[p.ID]; ok {
+			cs.Removed = append(cs.Removed, p)
+		}
+	}
+	return cs
+}
+
+func samePolicy(a, b Policy) bool {
+	a.CreatedAt, b.CreatedAt = time.Time{}, time.Time{}
+	return reflect.DeepEqual(a, b)
+}
+
+// Publish snapshots the draft policies as a new revision.
+func (s *Store) Publish(ctx context.Context, message string) (Revision, error) {
+	var rev Revision
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		cs, err := changeset(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if cs.Empty() {
+			return ErrNoChanges
+		}
+		draft, err := queryPolicies(ctx, tx)
+		if err != nil {
+			return err
+		}
+		rev, err = insertRevision(ctx, tx, draft, message, 0)
+		if err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, AuditPublish, ResourceRevision, rev.Number, cs, rev)
+	})
+	return rev, err
+}
+
+// DiscardDraft resets the draft policies to the published revision.
+func (s *Store) DiscardDraft(ctx context.Context) (Changeset, error) {
+	var discarded Changeset
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		if discarded, err = changeset(ctx, tx); err != nil {
+			return err
+		}
+		published, err := publishedRevision(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if err := replacePolicies(ctx, tx, published.Policies); err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, AuditDiscard, ResourceRevision, published.Number, discarded, nil)
+	})
+	return discarded, err
+}
+
+// RestoreRevision replaces the draft with an earlier revision's policies and
+// publishes it as a new revision in one step. It returns ErrZoneDeleted if
+// the revision names a zone that no longer exists.
+func (s *Store) RestoreRevision(ctx context.Context, number int64, message string) (Revision, error) {
+	var rev Revision
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		source, err := getRevision(ctx, tx, number)
+		if err != nil {
+			return err
+		}
+		if err := replacePolicies(ctx, tx, source.Policies); err != nil {
+			return err
+		}
+		if message == "" {
+			message = fmt.Sprintf("restore revision %d", number)
+		}
+		draft, err := queryPolicies(ctx, tx)
+		if err != nil {
+			return err
+		}
+		rev, err = insertRevision(ctx, tx, draft, message, number)
+		if err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, AuditRestore, ResourceRevision, rev.Number, source, rev)
+	})
+	return rev, err
+}
+
+func insertRevision(ctx context.Context, tx *sql.Tx, policies []Policy, message string, restoredFrom int64) (Revision, error) {
+	if policies == nil {
+		policies = []Policy{}
+	}
+	payload, err := json.Marshal(policies)
+	if err != nil {
+		return Revision{}, fmt.Errorf("encode revision: %w", err)
+	}
+	var restored any
+	if restoredFrom != 0 {
+		restored = restoredFrom
+	}
+	res, err := tx.ExecContext(ctx, `INSERT INTO policy_revisions (published_at, actor, message, restored_from, payload) VALUES (?, ?, ?, ?, ?)`,
+		time.Now().UTC(), actorFrom(ctx), message, restored, string(payload))
+	if err != nil {
+		return Revision{}, err
+	}
+	number, err := res.LastInsertId()
+	if err != nil {
+		return Revision{}, err
+	}
+	return getRevision(ctx, tx, number)
+}
+
+// renameRevisionZone rewrites the zone names stored in every revision's
+// payload after a zone rename, so published and earlier revisions still
+// compile and restore. Only the name changes; the revisions keep
+// referring to the same zone.
+func renameRevisionZone(ctx context.Context, tx *sql.Tx, from, to string) error {
+	rows, err := tx.QueryContext(ctx, `SELECT number FROM policy_revisions ORDER BY number`)
+	if err != nil {
+		return err
+	}
+	var numbers []int64
+	for rows.Next() {
+		var number int64
+		if err := rows.Scan(&number); err != nil {
+			rows.Close()
+			return err
+		}
+		numbers = append(numbers, number)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, number := range numbers {
+		rev, err := getRevision(ctx, tx, number)
+		if err != nil {
+			return err
+		}
+		changed := false
+		for i := range rev.Policies {
+			if rev.Policies[i].Source == from {
+				rev.Policies[i].Source, changed = to, true
+			}
+			if rev.Policies[i].Destination == from {
+				rev.Policies[i].Destination, changed = to, true
+			}
+		}
+		if !changed {
+			continue
+		}
+		payload, err := json.Marshal(rev.Policies)
+		if err != nil {
+			return fmt.Errorf("encode revision %d: %w", number, err)
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE policy_revisions SET payload = ? WHERE number = ?`, string(payload), number); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replacePolicies makes the draft exactly policies, keeping their IDs so
+// later diffs line up with the revision they came from.
+func replacePolicies(ctx context.Context, tx *sql.Tx, policies []Policy) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM policies`); err != nil {
+		return err
+	}
+	for _, p := range policies {
+		sourceID, destinationID, err := policyZoneIDs(ctx, tx, p)
+		if errors.Is(err, ErrInvalidReference) {
+			return fmt.Errorf("%w: policy %s: %v", ErrZoneDeleted, p.Name, err)
+		}
+		if err != nil {
+			return fmt.Errorf("policy %s: %w", p.Name, err)
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO policies (id, name, source, source_zone_id, destination, destination_zone_id, action, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			p.ID, p.Name, p.Source, sourceID, p.Destination, destinationID, p.Action, p.CreatedAt)
+		if err != nil {
+			return translateError(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package controllerdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInUse is returned when deleting a resource that others still reference.
+	ErrInUse = errors.New("resource is still referenced")
+	// ErrZoneDeleted is returned when restoring a revision whose policies
+	// name a zone that has since been deleted.
+	ErrZoneDeleted = errors.New("revision uses a deleted zone")
+)
+
+// Zone groups nodes and address ranges. Nodes belong to exactly one zone and
+// policies name a source and a destination zone.
+type Zone struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	CIDRs       []string  `json:"cidrs"`
+	Nodes       []string  `json:"nodes"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+const zoneColumns = `id, name, description, created_at`
+
+func (s *Store) ListZones(ctx context.Context) ([]Zone, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+zoneColumns+` FROM zones ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	var zones []Zone
+	for rows.Next() {
+		var z Zone
+		if err := rows.Scan(&z.ID, &z.Name, &z.Description, &z.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		zones = append(zones, z)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range zones {
+		if err := loadZoneMembers(ctx, s.db, &zones[i]); err != nil {
+			return nil, err
+		}
+	}
+	return zones, nil
+}
+
+func (s *Store) GetZone(ctx context.Context, id int64) (Zone, error) {
+	return getZone(ctx, s.db, id)
+}
+
+func getZone(ctx context.Context, q dbQueryer, id int64) (Zone, error) {
+	var z Zone
+	err := q.QueryRowContext(ctx, `SELECT `+zoneColumns+` FROM zones WHERE id = ?`, id).
+		Scan(&z.ID, &z.Name, &z.Description, &z.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Zone{}, ErrNotFound
+	}
+	if err != nil {
+		return Zone{}, err
+	}
+	if err := loadZoneMembers(ctx, q, &z); err != nil {
+		return Zone{}, err
+	}
+	return z, nil
+}
+
+func loadZoneMembers(ctx context.Context, q queryer, z *Zone) error {
+	cidrs, err := queryStrings(ctx, q, `SELECT cidr FROM zone_cidrs WHERE zone_id = ? ORDER BY cidr`, z.ID)
+	if err != nil {
+		return err
+	}
+	nodes, err := queryStrings(ctx, q, `SELECT name FROM nodes WHERE zone_id = ? ORDER BY id`, z.ID)
+	if err != nil {
+		return err
+	}
+	z.CIDRs = cidrs
+	z.Nodes = nodes
+	return nil
+}
+
+func queryStrings(ctx context.Context, q queryer, query string, args ...any) ([]string, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := []string{}
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+func (s *Store) CreateZone(ctx context.Context, z Zone) (Zone, error) {
+	var created Zone
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `INSERT INTO zones (name, description) VALUES (?, ?)`, z.Name, z.Description)
+		if err != nil {
+			return translateError(err)
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		if err := replaceZoneCIDRs(ctx, tx, id, z.CIDRs); err != nil {
+			return err
+		}
+		if created, err = getZone(ctx, tx, id); err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, AuditCreate, ResourceZone, id, nil, created)
+	})
+	return created, err
+}
+
+func (s *Store) UpdateZone(ctx context.Context, z Zone) (Zone, error) {
+	var updated Zone
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		before, err := getZone(ctx, tx, z.ID)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE zones SET name = ?, description = ? WHERE id = ?`, z.Name, z.Description, z.ID); err != nil {
+			return translateError(err)
+		}
+		// Keep the denormalized zone names on nodes and policies in step.
+		if _, err := tx.ExecContext(ctx, `UPDATE nodes SET zone = ? WHERE zone_id = ?`, z.Name, z.ID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE policies SET source = ? WHERE source_zone_id = ?`, z.Name, z.ID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE policies SET destination = ? WHERE destination_zone_id = ?`, z.Name, z.ID); err != nil {
+			return err
+		}
+		if z.Name != before.Name {
+			if err := renameRevisionZone(ctx, tx, before.Name, z.Name); err != nil {
+				return err
+			}
+		}
+		if err := replaceZoneCIDRs(ctx, tx, z.ID, z.CIDRs); err != nil {
+			return err
+		}
+		if updated, err = getZone(ctx, tx, z.ID); err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, AuditUpdate, ResourceZone, z.ID, before, updated)
+	})
+	return updated, err
+}
+
+// DeleteZone removes a zone that no node, draft policy or published policy
+// references.
+func (s *Store) DeleteZone(ctx context.Context, id int64) (Zone, error) {
+	var deleted Zone
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		if deleted, err = getZone(ctx, tx, id); err != nil {
+			return err
+		}
+		var policies int
+		err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM policies WHERE source_zone_id = ? OR destination_zone_id = ?`, id, id).Scan(&policies)
+		if err != nil {
+			return err
+		}
+		published, err := publishedRevision(ctx, tx)
+		if err != nil {
+			return err
+		}
+		for _, p := range published.Policies {
+			if p.Source == deleted.Name || p.Destination == deleted.Name {
+				policies++
+			}
+		}
+		if len(deleted.Nodes) > 0 || policies > 0 {
+			return fmt.Errorf("%w: zone %s has %d nodes and %d draft or published policies", ErrInUse, deleted.Name, len(deleted.Nodes), policies)
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM zones WHERE id = ?`, id); err != nil {
+			return translateError(err)
+		}
+		return recordAudit(ctx, tx, AuditDelete, ResourceZone, id, deleted, nil)
+	})
+	return deleted, err
+}
+
+func replaceZoneCIDRs(ctx context.Context, tx *sql.Tx, zoneID int64, cidrs []string) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM zone_cidrs WHERE zone_id = ?`, zoneID); err != nil {
+		return err
+	}
+	for _, cidr := range cidrs {
+		if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO zone_cidrs (zone_id, cidr) VALUES (?, ?)`, zoneID, strings.TrimSpace(cidr)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type rowQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// zoneID resolves a zone name, returning ErrInvalidReference when it does
+// not exist.
+func zoneID(ctx context.Context, q rowQueryer, name string) (int64, error) {
+	var id int64
+	err := q.QueryRowContext(ctx, `SELECT id FROM zones WHERE name = ?`, name).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("%w: zone %q", ErrInvalidReference, name)
+	}
+	return id, err
+}
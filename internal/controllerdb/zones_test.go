@@ -0,0 +1,121 @@
+package controllerdb_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"octaroute/internal/controllerdb"
+	"octaroute/internal/controlplane"
+)
+
+func openStore(t *testing.T) *controllerdb.Store {
+	t.Helper()
+	store, err := controllerdb.Open(filepath.Join(t.TempDir(), "controller.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	return store
+}
+
+func TestRenameZoneKeepsRevisionsUsable(t *testing.T) {
+	ctx := context.Background()
+	store := openStore(t)
+	office, err := store.CreateZone(ctx, controllerdb.Zone{Name: "office", CIDRs: []string{"10.0.0.0/24"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uk, err := store.CreateZone(ctx, controllerdb.Zone{Name: "uk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := []controllerdb.Node{
+		{Name: "gw", Address: "10.0.0.1", Zone: "office", Role: controllerdb.RoleGateway},
+		{Name: "london", Address: "10.1.0.1", Zone: "uk", Role: controllerdb.RoleExit, Endpoint: "198.51.100.1:51820", PublicKey: "key"},
+	}
+	for _, n := range nodes {
+		if _, err := store.CreateNode(ctx, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.CreatePolicy(ctx, controllerdb.Policy{Name: "to-uk", Source: "office", Destination: "uk", Action: "route"}); err != nil {
+		t.Fatal(err)
+	}
+	first, err := store.Publish(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uk.Name = "united-kingdom"
+	if _, err := store.UpdateZone(ctx, uk); err != nil {
+		t.Fatal(err)
+	}
+
+	in, err := controlplane.LoadInputs(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests, err := controlplane.Compile(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 || len(requests[0].Request.Policies) != 1 || len(requests[0].Skipped) != 0 {
+		t.Fatalf("requests after rename = %+v", requests)
+	}
+	if got := requests[0].Request.Policies[0].Node; got != "london" {
+		t.Errorf("policy exits through %q, want london", got)
+	}
+
+	restored, err := store.RestoreRevision(ctx, first.Number, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := restored.Policies[0].Destination; got != "united-kingdom" {
+		t.Errorf("restored policy destination = %q, want united-kingdom", got)
+	}
+
+	if _, err := store.DeleteZone(ctx, office.ID); !errors.Is(err, controllerdb.ErrInUse) {
+		t.Fatalf("deleting a zone with nodes and policies: err = %v, want ErrInUse", err)
+	}
+}
+
+func TestDeleteZoneChecksPublishedPolicies(t *testing.T) {
+	ctx := context.Background()
+	store := openStore(t)
+	if _, err := store.CreateZone(ctx, controllerdb.Zone{Name: "office"}); err != nil {
+		t.Fatal(err)
+	}
+	uk, err := store.CreateZone(ctx, controllerdb.Zone{Name: "uk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := store.CreatePolicy(ctx, controllerdb.Policy{Name: "to-uk", Source: "office", Destination: "uk", Action: "route"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := store.Publish(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.DeletePolicy(ctx, policy.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.DeleteZone(ctx, uk.ID); !errors.Is(err, controllerdb.ErrInUse) {
+		t.Fatalf("deleting a zone the published revision uses: err = %v, want ErrInUse", err)
+	}
+	if _, err := store.Publish(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.DeleteZone(ctx, uk.ID); err != nil {
+		t.Fatalf("deleting a zone only an older revision uses: %v", err)
+	}
+
+	if _, err := store.RestoreRevision(ctx, first.Number, ""); !errors.Is(err, controllerdb.ErrZoneDeleted) {
+		t.Fatalf("restoring a revision that uses a deleted zone: err = %v, want ErrZoneDeleted", err)
+	}
+	if policies, err := store.ListPolicies(ctx); err != nil || len(policies) != 0 {
+		t.Fatalf("draft after failed restore = %+v, %v; want empty", policies, err)
+	}
+}
@@ -0,0 +1,163 @@
+package controlplane
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"octaroute/internal/controllerdb"
+	"octaroute/internal/routing"
+)
+
+const defaultKeepalive = 25
+
+// Inputs is the controller state a compilation reads.
+type Inputs struct {
+	Revision int64
+	Zones    []controllerdb.Zone
+	Nodes    []controllerdb.Node
+	Policies []controllerdb.Policy
+	Routes   []controllerdb.Route
+}
+
+// LoadInputs reads the current controller state from the store, taking
+// policies from the latest published revision rather than the draft.
+func LoadInputs(ctx context.Context, store *controllerdb.Store) (Inputs, error) {
+	var (
+		in  Inputs
+		err error
+	)
+	if in.Zones, err = store.ListZones(ctx); err != nil {
+		return Inputs{}, fmt.Errorf("list zones: %w", err)
+	}
+	if in.Nodes, err = store.ListNodes(ctx); err != nil {
+		return Inputs{}, fmt.Errorf("list nodes: %w", err)
+	}
+	published, err := store.PublishedRevision(ctx)
+	if err != nil {
+		return Inputs{}, fmt.Errorf("load published revision: %w", err)
+	}
+	in.Revision, in.Policies = published.Number, published.Policies
+	if in.Routes, err = store.ListRoutes(ctx); err != nil {
+		return Inputs{}, fmt.Errorf("list routes: %w", err)
+	}
+	return in, nil
+}
+
+// GatewayRequest is the compiled ApplyRequest for a single gateway node.
+type GatewayRequest struct {
+	Gateway controllerdb.Node    `json:"gateway"`
+	Request routing.ApplyRequest `json:"request"`
+	// Skipped explains each policy left out of Request because it could
+	// not be compiled for this gateway.
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// Compile turns the controller's nodes, policies and routes into one
+// ApplyRequest per gateway node.
+//
+// A policy's source zone selects the gateways it is installed on and its
+// destination zone selects the exit node their traffic egresses through.
+// The zones' CIDRs become the policy's source and destination matches; a
+// zone without CIDRs matches any address.
+// Routes attached to a gateway are installed on that gateway only; routes
+// attached to an exit are installed on every gateway that egresses through
+// it, bound to that exit's table.
+// A policy whose destination zone has no exit node is skipped for the
+// gateways it applies to and reported in their GatewayRequest.Skipped.
+func Compile(in Inputs) ([]GatewayRequest, error) {
+	nodes, policies, routes := in.Nodes, in.Policies, in.Routes
+	zoneCIDRs := make(map[string][]string, len(in.Zones))
+	for _, zone := range in.Zones {
+		zoneCIDRs[zone.Name] = zone.CIDRs
+	}
+	nodesByID := make(map[int64]controllerdb.Node, len(nodes))
+	var gateways []controllerdb.Node
+	exitsByZone := make(map[string][]controllerdb.Node)
+	for _, node := range nodes {
+		nodesByID[node.ID] = node
+		switch node.Role {
+		case controllerdb.RoleGateway:
+			gateways = append(gateways, node)
+		case controllerdb.RoleExit, "":
+			exitsByZone[node.Zone] = append(exitsByZone[node.Zone], node)
+		default:
+			return nil, fmt.Errorf("node %s has unknown role %q", node.Name, node.Role)
+		}
+	}
+	for zone := range exitsByZone {
+		exits := exitsByZone[zone]
+		sort.Slice(exits, func(i, j int) bool { return exits[i].ID < exits[j].ID })
+	}
+
+	requests := make([]GatewayRequest, 0, len(gateways))
+	for _, gateway := range gateways {
+		req := routing.ApplyRequest{
+			Nodes:    []routing.EgressNode{},
+			Policies: []routing.PolicyGroup{},
+			Routes:   []routing.StaticRoute{},
+		}
+		var skipped []string
+		exitNames := make(map[int64]string)
+		for _, policy := range policies {
+			if policy.Source != gateway.Zone {
+				continue
+			}
+			exits := exitsByZone[policy.Destination]
+			if len(exits) == 0 {
+				skipped = append(skipped, fmt.Sprintf("policy %s: no exit node in zone %s", policy.Name, policy.Destination))
+				continue
+			}
+			exit := exits[0]
+			if _, ok := exitNames[exit.ID]; !ok {
+				egress, err := egressNode(gateway, exit)
+				if err != nil {
+					return nil, fmt.Errorf("policy %s: %w", policy.Name, err)
+				}
+				exitNames[exit.ID] = egress.Name
+				req.Nodes = append(req.Nodes, egress)
+			}
+			req.Policies = append(req.Policies, routing.PolicyGroup{
+				Name:             policy.Name,
+				Node:             exit.Name,
+				SourceCIDRs:      zoneCIDRs[policy.Source],
+				DestinationCIDRs: zoneCIDRs[policy.Destination],
+				Action:           policy.Action,
+			})
+		}
+		for _, route := range routes {
+			owner, ok := nodesByID[route.NodeID]
+			if !ok {
+				return nil, fmt.Errorf("route %s: unknown node %d", route.CIDR, route.NodeID)
+			}
+			switch {
+			case owner.ID == gateway.ID:
+				req.Routes = append(req.Routes, routing.StaticRoute{CIDR: route.CIDR, NextHop: route.NextHop})
+			case exitNames[owner.ID] != "":
+				req.Routes = append(req.Routes, routing.StaticRoute{CIDR: route.CIDR, NextHop: route.NextHop, Node: owner.Name})
+			}
+		}
+		requests = append(requests, GatewayRequest{Gateway: gateway, Request: req, Skipped: skipped})
+	}
+	return requests, nil
+}
+
+// egressNode is the tunnel from gateway to exit. The gateway's address is
+// its tunnel address, assigned to the egress interface as the source of
+// the traffic it carries.
+func egressNode(gateway, exit controllerdb.Node) (routing.EgressNode, error) {
+	if exit.PublicKey == "" || exit.Endpoint == "" {
+		return routing.EgressNode{}, fmt.Errorf("exit node %s is missing endpoint or public key", exit.Name)
+	}
+	if gateway.Address == "" {
+		return routing.EgressNode{}, fmt.Errorf("gateway %s has no tunnel address", gateway.Name)
+	}
+	return routing.EgressNode{
+		Name:                exit.Name,
+		Endpoint:            exit.Endpoint,
+		PublicKey:           exit.PublicKey,
+		AllowedIPs:          []string{"0.0.0.0/0", "::/0"},
+		LocalAddress:        gateway.Address,
+		PersistentKeepalive: defaultKeepalive,
+	}, nil
+}
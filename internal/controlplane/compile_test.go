@@ -0,0 +1,126 @@
+package controlplane
+
+import (
+	"reflect"
+	"testing"
+
+	"octaroute/internal/controllerdb"
+	"octaroute/internal/routing"
+)
+
+func TestCompile(t *testing.T) {
+	zones := []controllerdb.Zone{
+		{Name: "office", CIDRs: []string{"10.0.0.0/24"}},
+		{Name: "lab", CIDRs: []string{"10.0.1.0/24"}},
+		{Name: "uk", CIDRs: []string{"203.0.113.0/24"}},
+		{Name: "any", CIDRs: []string{}},
+		{Name: "empty", CIDRs: []string{}},
+	}
+	gateway := controllerdb.Node{ID: 1, Name: "gw", Address: "10.42.0.2/24", Zone: "office", Role: controllerdb.RoleGateway}
+	london := controllerdb.Node{ID: 3, Name: "london", Zone: "uk", Role: controllerdb.RoleExit, Endpoint: "198.51.100.3:51820", PublicKey: "london-key"}
+	leeds := controllerdb.Node{ID: 2, Name: "leeds", Zone: "uk", Role: controllerdb.RoleExit, Endpoint: "198.51.100.2:51820", PublicKey: "leeds-key"}
+	frankfurt := controllerdb.Node{ID: 4, Name: "frankfurt", Zone: "any", Endpoint: "198.51.100.4:51820", PublicKey: "frankfurt-key"}
+	leedsEgress := routing.EgressNode{
+		Name:                "leeds",
+		Endpoint:            "198.51.100.2:51820",
+		PublicKey:           "leeds-key",
+		AllowedIPs:          []string{"0.0.0.0/0", "::/0"},
+		LocalAddress:        "10.42.0.2/24",
+		PersistentKeepalive: defaultKeepalive,
+	}
+
+	tests := []struct {
+		name     string
+		nodes    []controllerdb.Node
+		policies []controllerdb.Policy
+		want     routing.ApplyRequest
+		skipped  []string
+	}{
+		{
+			name:     "only policies from the gateway's zone",
+			nodes:    []controllerdb.Node{gateway, leeds},
+			policies: []controllerdb.Policy{{Name: "office-uk", Source: "office", Destination: "uk", Action: "allow"}, {Name: "lab-uk", Source: "lab", Destination: "uk", Action: "allow"}},
+			want: routing.ApplyRequest{
+				Nodes:    []routing.EgressNode{leedsEgress},
+				Policies: []routing.PolicyGroup{{Name: "office-uk", Node: "leeds", SourceCIDRs: []string{"10.0.0.0/24"}, DestinationCIDRs: []string{"203.0.113.0/24"}, Action: "allow"}},
+				Routes:   []routing.StaticRoute{},
+			},
+		},
+		{
+			name:     "first exit by ID",
+			nodes:    []controllerdb.Node{gateway, london, leeds},
+			policies: []controllerdb.Policy{{Name: "office-uk", Source: "office", Destination: "uk", Action: "allow"}},
+			want: routing.ApplyRequest{
+				Nodes:    []routing.EgressNode{leedsEgress},
+				Policies: []routing.PolicyGroup{{Name: "office-uk", Node: "leeds", SourceCIDRs: []string{"10.0.0.0/24"}, DestinationCIDRs: []string{"203.0.113.0/24"}, Action: "allow"}},
+				Routes:   []routing.StaticRoute{},
+			},
+		},
+		{
+			name:     "destination zone without CIDRs matches any address",
+			nodes:    []controllerdb.Node{gateway, frankfurt},
+			policies: []controllerdb.Policy{{Name: "office-any", Source: "office", Destination: "any", Action: "allow"}},
+			want: routing.ApplyRequest{
+				Nodes: []routing.EgressNode{{
+					Name:                "frankfurt",
+					Endpoint:            "198.51.100.4:51820",
+					PublicKey:           "frankfurt-key",
+					AllowedIPs:          []string{"0.0.0.0/0", "::/0"},
+					LocalAddress:        "10.42.0.2/24",
+					PersistentKeepalive: defaultKeepalive,
+				}},
+				Policies: []routing.PolicyGroup{{Name: "office-any", Node: "frankfurt", SourceCIDRs: []string{"10.0.0.0/24"}, DestinationCIDRs: []string{}, Action: "allow"}},
+				Routes:   []routing.StaticRoute{},
+			},
+		},
+		{
+			name:     "destination zone without exits is skipped",
+			nodes:    []controllerdb.Node{gateway, leeds},
+			policies: []controllerdb.Policy{{Name: "office-empty", Source: "office", Destination: "empty", Action: "allow"}, {Name: "office-uk", Source: "office", Destination: "uk", Action: "allow"}},
+			want: routing.ApplyRequest{
+				Nodes:    []routing.EgressNode{leedsEgress},
+				Policies: []routing.PolicyGroup{{Name: "office-uk", Node: "leeds", SourceCIDRs: []string{"10.0.0.0/24"}, DestinationCIDRs: []string{"203.0.113.0/24"}, Action: "allow"}},
+				Routes:   []routing.StaticRoute{},
+			},
+			skipped: []string{"policy office-empty: no exit node in zone empty"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests, err := Compile(Inputs{Zones: zones, Nodes: tt.nodes, Policies: tt.policies})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(requests) != 1 {
+				t.Fatalf("got %d requests, want 1", len(requests))
+			}
+			if got := requests[0].Request; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("request = %+v, want %+v", got, tt.want)
+			}
+			if got := requests[0].Skipped; !reflect.DeepEqual(got, tt.skipped) {
+				t.Errorf("skipped = %q, want %q", got, tt.skipped)
+			}
+		})
+	}
+}
+
+func TestCompileRejectsIncompleteNodes(t *testing.T) {
+	zones := []controllerdb.Zone{{Name: "office"}, {Name: "uk"}}
+	policies := []controllerdb.Policy{{Name: "office-uk", Source: "office", Destination: "uk", Action: "allow"}}
+	exit := controllerdb.Node{ID: 2, Name: "leeds", Zone: "uk", Role: controllerdb.RoleExit, Endpoint: "198.51.100.2:51820", PublicKey: "leeds-key"}
+	tests := []struct {
+		name  string
+		nodes []controllerdb.Node
+	}{
+		{"gateway without address", []controllerdb.Node{{ID: 1, Name: "gw", Zone: "office", Role: controllerdb.RoleGateway}, exit}},
+		{"exit without public key", []controllerdb.Node{{ID: 1, Name: "gw", Address: "10.42.0.2", Zone: "office", Role: controllerdb.RoleGateway}, {ID: 2, Name: "leeds", Zone: "uk", Endpoint: "198.51.100.2:51820"}}},
+		{"unknown role", []controllerdb.Node{{ID: 1, Name: "gw", Zone: "office", Role: "relay"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Compile(Inputs{Zones: zones, Nodes: tt.nodes, Policies: policies}); err == nil {
+				t.Fatal("Compile succeeded")
+			}
+		})
+	}
+}
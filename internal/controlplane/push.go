@@ -0,0 +1,202 @@
+package controlplane
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"octaroute/internal/controllerdb"
+	"octaroute/internal/routing"
+)
+
+// Pusher compiles the controller state and delivers it to every gateway's
+// /apply endpoint, recording the outcome per gateway.
+type Pusher struct {
+	Store         *controllerdb.Store
+	Client        *http.Client
+	APIKey        string
+	Header        string
+	MaxAttempts   int
+	RetryInterval time.Duration
+
+	// pushMu serializes PushAll so the Run loop and a manual push never
+	// compile or deliver concurrently.
+	pushMu sync.Mutex
+
+	mu      sync.Mutex
+	trigger chan struct{}
+}
+
+// Trigger schedules a push on the Run loop without blocking the caller.
+func (p *Pusher) Trigger() {
+	select {
+	case p.triggerCh() <- struct{}{}:
+	default:
+	}
+}
+
+func (p *Pusher) triggerCh() chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.trigger == nil {
+		p.trigger = make(chan struct{}, 1)
+	}
+	return p.trigger
+}
+
+// Run pushes whenever Trigger is called and re-pushes every RetryInterval
+// while any gateway's last push failed.
+func (p *Pusher) Run(ctx context.Context) {
+	interval := p.RetryInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	trigger := p.triggerCh()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-trigger:
+		case <-ticker.C:
+			if !p.hasFailures(ctx) {
+				continue
+			}
+		}
+		if _, err := p.PushAll(ctx); err != nil {
+			log.Printf("push: %v", err)
+		}
+	}
+}
+
+func (p *Pusher) hasFailures(ctx context.Context) bool {
+	statuses, err := p.Store.ListPushStatus(ctx)
+	if err != nil {
+		log.Printf("push: list status: %v", err)
+		return false
+	}
+	for _, status := range statuses {
+		if !status.Success {
+			return true
+		}
+	}
+	return false
+}
+
+// PushAll compiles the current state and pushes it to every gateway. A
+// failed gateway does not stop the others; its failure is recorded and
+// reported in the returned statuses.
+func (p *Pusher) PushAll(ctx context.Context) ([]controllerdb.PushStatus, error) {
+	p.pushMu.Lock()
+	defer p.pushMu.Unlock()
+	in, err := LoadInputs(ctx, p.Store)
+	if err != nil {
+		return nil, err
+	}
+	requests, err := Compile(in)
+	if err != nil {
+		return nil, fmt.Errorf("compile: %w", err)
+	}
+	statuses := make([]controllerdb.PushStatus, 0, len(requests))
+	for _, req := range requests {
+		status := p.push(ctx, req)
+		if err := p.Store.RecordPush(ctx, status); err != nil {
+			return statuses, err
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func (p *Pusher) push(ctx context.Context, req GatewayRequest) controllerdb.PushStatus {
+	attempts := p.MaxAttempts
+	if attempts <= 0 {
+		attempts = 3
+	}
+	status := controllerdb.PushStatus{
+		NodeID:   req.Gateway.ID,
+		NodeName: req.Gateway.Name,
+		Skipped:  req.Skipped,
+	}
+	backoff := time.Second
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		status.Attempts = attempt
+		var state routing.RoutingState
+		state, err = p.apply(ctx, req)
+		if err == nil {
+			status.Success = true
+			status.AppliedAt = state.AppliedAt
+			break
+		}
+		if attempt == attempts {
+			break
+		}
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+			continue
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		break
+	}
+	if err != nil {
+		status.Error = err.Error()
+		log.Printf("push to %s failed after %d attempts: %v", req.Gateway.Name, status.Attempts, err)
+	}
+	status.PushedAt = time.Now().UTC()
+	return status
+}
+
+func (p *Pusher) apply(ctx context.Context, req GatewayRequest) (routing.RoutingState, error) {
+	if req.Gateway.APIURL == "" {
+		return routing.RoutingState{}, fmt.Errorf("gateway %s has no apiUrl", req.Gateway.Name)
+	}
+	body, err := json.Marshal(req.Request)
+	if err != nil {
+		return routing.RoutingState{}, fmt.Errorf("marshal apply request: %w", err)
+	}
+	url := strings.TrimSuffix(req.Gateway.APIURL, "/") + "/apply"
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return routing.RoutingState{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if p.APIKey != "" {
+		header := p.Header
+		if header == "" {
+			header = "X-API-Key"
+		}
+		httpReq.Header.Set(header, p.APIKey)
+	}
+	client := p.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return routing.RoutingState{}, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return routing.RoutingState{}, fmt.Errorf("read apply response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return routing.RoutingState{}, fmt.Errorf("apply returned %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	var state routing.RoutingState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return routing.RoutingState{}, fmt.Errorf("decode apply response: %w", err)
+	}
+	return state, nil
+}
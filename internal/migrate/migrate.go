@@ -0,0 +1,134 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ErrSchemaTooNew is returned when a database was migrated by a newer build
+// than the one opening it.
+var ErrSchemaTooNew = errors.New("database schema is newer than this build supports")
+
+// Migration is a single ordered schema change. Up runs inside a transaction
+// together with the schema_version bookkeeping, so a failed migration leaves
+// the database at the previous version.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, tx *sql.Tx) error
+}
+
+// Exec returns an Up function that runs a fixed SQL script.
+func Exec(script string) func(ctx context.Context, tx *sql.Tx) error {
+	return func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, script)
+		return err
+	}
+}
+
+// Apply brings db up to the newest of migrations, which must be sorted by
+// strictly increasing Version starting at 1. It refuses to touch a database
+// whose recorded version is newer than the last known migration.
+func Apply(ctx context.Context, db *sql.DB, migrations []Migration) ([]Migration, error) {
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %q has version %d, want %d", m.Name, m.Version, i+1)
+		}
+	}
+	_, err := db.ExecContext(ctx, `
+    CREATE TABLE IF NOT EXISTS schema_version (
+        version INTEGER PRIMARY KEY,
+        name TEXT NOT NULL,
+        applied_at DATETIME NOT NULL
+    );
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("create schema_version: %w", err)
+	}
+	current, err := Version(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if current > len(migrations) {
+		return nil, fmt.Errorf("%w: database is at version %d, latest known is %d", ErrSchemaTooNew, current, len(migrations))
+	}
+	var applied []Migration
+	for _, m := range migrations[current:] {
+		if err := applyOne(ctx, db, m); err != nil {
+			return applied, err
+		}
+		log.Printf("applied schema migration %d (%s)", m.Version, m.Name)
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+func applyOne(ctx context.Context, db *sql.DB, m Migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+	}
+	defer func() { _ = tx.Rollback() }()
+	if err := m.Up(ctx, tx); err != nil {
+		return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)`,
+		m.Version, m.Name, time.Now().UTC()); err != nil {
+		return fmt.Errorf("record migration %d (%s): %w", m.Version, m.Name, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit migration %d (%s): %w", m.Version, m.Name, err)
+	}
+	return nil
+}
+
+// Version reports the highest migration applied to db, or 0 for a database
+// that predates versioning.
+func Version(ctx context.Context, db *sql.DB) (int, error) {
+	var version sql.NullInt64
+	if err := db.QueryRowContext(ctx, `SELECT MAX(version) FROM schema_version`).Scan(&version); err != nil {
+		return 0, fmt.Errorf("read schema version: %w", err)
+	}
+	return int(version.Int64), nil
+}
+
+// AddColumn adds a column to table unless it already exists, so migrations
+// can run against databases whose schema was extended before versioning.
+func AddColumn(ctx context.Context, tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("inspect %s: %w", table, err)
+	}
+	found := false
+	for rows.Next() {
+		var (
+			cid        int
+			name, kind string
+			notNull    int
+			dflt       sql.NullString
+			pk         int
+		)
+		if err := rows.Scan(&cid, &name, &kind, &notNull, &dflt, &pk); err != nil {
+			rows.Close()
+			return fmt.Errorf("inspect %s: %w", table, err)
+		}
+		if name == column {
+			found = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("inspect %s: %w", table, err)
+	}
+	if found {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+var testMigrations = []Migration{
+	{Version: 1, Name: "items", Up: Exec(`CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT NOT NULL)`)},
+	{Version: 2, Name: "item colour", Up: func(ctx context.Context, tx *sql.Tx) error {
+		return AddColumn(ctx, tx, "items", "colour", "TEXT NOT NULL DEFAULT ''")
+	}},
+}
+
+func TestApplyRunsPendingMigrationsOnce(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+	applied, err := Apply(ctx, db, testMigrations[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 1 {
+		t.Fatalf("applied %d migrations, want 1", len(applied))
+	}
+	if _, err := db.Exec(`INSERT INTO items (name) VALUES ('a')`); err != nil {
+		t.Fatal(err)
+	}
+	applied, err = Apply(ctx, db, testMigrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 1 || applied[0].Version != 2 {
+		t.Fatalf("applied %+v, want only version 2", applied)
+	}
+	if applied, err = Apply(ctx, db, testMigrations); err != nil || len(applied) != 0 {
+		t.Fatalf("re-apply: applied %d, err %v", len(applied), err)
+	}
+	if v, err := Version(ctx, db); err != nil || v != 2 {
+		t.Fatalf("Version = %d, %v; want 2", v, err)
+	}
+	var colour string
+	if err := db.QueryRow(`SELECT colour FROM items WHERE name = 'a'`).Scan(&colour); err != nil {
+		t.Fatalf("existing row after adding column: %v", err)
+	}
+}
+
+func TestApplyRollsBackFailedMigration(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+	failing := append(testMigrations[:1:1], Migration{Version: 2, Name: "broken", Up: func(ctx context.Context, tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `CREATE TABLE half_done (id INTEGER)`); err != nil {
+			return err
+		}
+		return errors.New("boom")
+	}})
+	if _, err := Apply(ctx, db, failing); err == nil {
+		t.Fatal("failing migration reported success")
+	}
+	if v, _ := Version(ctx, db); v != 1 {
+		t.Fatalf("version after failed migration = %d, want 1", v)
+	}
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'half_done'`).Scan(&n); err != nil || n != 0 {
+		t.Fatalf("failed migration left its table behind (count %d, err %v)", n, err)
+	}
+}
+
+func TestApplyRefusesNewerSchema(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+	if _, err := Apply(ctx, db, testMigrations); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Apply(ctx, db, testMigrations[:1]); !errors.Is(err, ErrSchemaTooNew) {
+		t.Fatalf("err = %v, want ErrSchemaTooNew", err)
+	}
+}
+
+func TestApplyRejectsMisnumberedMigrations(t *testing.T) {
+	misnumbered := []Migration{{Version: 2, Name: "gap", Up: Exec(`SELECT 1`)}}
+	if _, err := Apply(context.Background(), openDB(t), misnumbered); err == nil {
+		t.Fatal("migration list starting at version 2 accepted")
+	}
+}
+
+func TestAddColumnSkipsExistingColumn(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+	if _, err := db.Exec(`CREATE TABLE items (id INTEGER PRIMARY KEY, colour TEXT)`); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	for i := 0; i < 2; i++ {
+		if err := AddColumn(ctx, tx, "items", "colour", "TEXT"); err != nil {
+			t.Fatalf("AddColumn on existing column: %v", err)
+		}
+		if err := AddColumn(ctx, tx, "items", "size", "INTEGER"); err != nil {
+			t.Fatalf("AddColumn run %d: %v", i+1, err)
+		}
+	}
+}
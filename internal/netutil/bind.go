@@ -9,22 +9,34 @@ import (
 )
 
 func ListenWithOptionalDevice(ctx context.Context, network, address, device string) (net.Listener, error) {
-	lc := net.ListenConfig{}
-	if device != "" && runtime.GOOS == "linux" {
-		lc.Control = func(_, _ string, c syscall.RawConn) error {
-			var controlErr error
-			if err := c.Control(func(fd uintptr) {
-				controlErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, device)
-			}); err != nil {
-				return err
-			}
-			return controlErr
-		}
-	}
-
+	lc := net.ListenConfig{Control: DeviceControl(device, 0)}
 	ln, err := lc.Listen(ctx, network, address)
 	if err != nil && device != "" && runtime.GOOS != "linux" {
 		return nil, errors.New("device binding is only supported on linux")
 	}
 	return ln, err
 }
+
+// DeviceControl returns a socket control function that binds sockets to
+// device with SO_BINDTODEVICE and, when mark is non-zero, sets their fwmark
+// so policy routing rules apply to them. It returns nil when there is
+// nothing to set or the platform is not linux.
+func DeviceControl(device string, mark int) func(network, address string, c syscall.RawConn) error {
+	if (device == "" && mark == 0) || runtime.GOOS != "linux" {
+		return nil
+	}
+	return func(_, _ string, c syscall.RawConn) error {
+		var controlErr error
+		if err := c.Control(func(fd uintptr) {
+			if device != "" {
+				controlErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, device)
+			}
+			if controlErr == nil && mark != 0 {
+				controlErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+			}
+		}); err != nil {
+			return err
+		}
+		return controlErr
+	}
+}
@@ -0,0 +1,274 @@
+package routing
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default allocation ranges. They stop short of the kernel's reserved
+// default (253), main (254) and local (255) tables.
+const (
+	DefaultTableIDMin = 101
+	DefaultTableIDMax = 250
+	DefaultMarkMin    = 101
+	DefaultMarkMax    = 250
+)
+
+// TableAllocation is the route table and fwmark owned by an egress node.
+type TableAllocation struct {
+	Node    string `json:"node"`
+	TableID int    `json:"tableId"`
+	Mark    int    `json:"mark"`
+}
+
+// Allocator hands out route table IDs and fwmarks per egress node and
+// persists them in the routing state database, so a node keeps its table
+// and mark however the nodes in later requests are ordered. New IDs skip
+// tables and marks the host already uses. Allocations that fall outside a
+// since-narrowed range are kept rather than renumbered.
+type Allocator struct {
+	Store      *StateStore
+	TableIDMin int
+	TableIDMax int
+	MarkMin    int
+	MarkMax    int
+}
+
+func (a *Allocator) ranges() (tableMin, tableMax, markMin, markMax int) {
+	tableMin, tableMax, markMin, markMax = a.TableIDMin, a.TableIDMax, a.MarkMin, a.MarkMax
+	if tableMin <= 0 {
+		tableMin = DefaultTableIDMin
+	}
+	if tableMax <= 0 {
+		tableMax = DefaultTableIDMax
+	}
+	if markMin <= 0 {
+		markMin = DefaultMarkMin
+	}
+	if markMax <= 0 {
+		markMax = DefaultMarkMax
+	}
+	return tableMin, tableMax, markMin, markMax
+}
+
+// Allocate returns the allocation for every node, assigning new ones as
+// needed. With commit unset the new allocations are computed but not
+// saved, which is what Plan uses.
+func (a *Allocator) Allocate(ctx context.Context, nodes []string, commit bool) (map[string]TableAllocation, error) {
+	tx, err := a.Store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("allocate tables: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	existing, err := queryAllocations(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	usedTables := make(map[int]bool, len(existing))
+	usedMarks := make(map[int]bool, len(existing))
+	for _, alloc := range existing {
+		usedTables[alloc.TableID] = true
+		usedMarks[alloc.Mark] = true
+	}
+
+	result := make(map[string]TableAllocation, len(nodes))
+	var hostTables, hostMarks map[int]bool
+	tableMin, tableMax, markMin, markMax := a.ranges()
+	for _, node := range nodes {
+		if alloc, ok := existing[node]; ok {
+			result[node] = alloc
+			continue
+		}
+		if _, ok := result[node]; ok {
+			continue
+		}
+		if hostTables == nil {
+			if hostTables, hostMarks, err = hostUsage(ctx); err != nil {
+				return nil, err
+			}
+		}
+		table, ok := firstFree(tableMin, tableMax, usedTables, hostTables)
+		if !ok {
+			return nil, fmt.Errorf("no free route table ID in %d-%d for node %s", tableMin, tableMax, node)
+		}
+		mark, ok := firstFree(markMin, markMax, usedMarks, hostMarks)
+		if !ok {
+			return nil, fmt.Errorf("no free fwmark in %d-%d for node %s", markMin, markMax, node)
+		}
+		usedTables[table], usedMarks[mark] = true, true
+		alloc := TableAllocation{Node: node, TableID: table, Mark: mark}
+		result[node] = alloc
+		if commit {
+			if _, err := tx.ExecContext(ctx, `INSERT INTO table_allocations (node, table_id, mark, allocated_at) VALUES (?, ?, ?, ?)`,
+				node, table, mark, time.Now().UTC()); err != nil {
+				return nil, fmt.Errorf("save allocation for %s: %w", node, err)
+			}
+		}
+	}
+	if !commit {
+		return result, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("allocate tables: %w", err)
+	}
+	return result, nil
+}
+
+// Release frees the allocations of every node not in keep.
+func (a *Allocator) Release(ctx context.Context, keep []string) error {
+	existing, err := queryAllocations(ctx, a.Store.db)
+	if err != nil {
+		return err
+	}
+	wanted := make(map[string]bool, len(keep))
+	for _, node := range keep {
+		wanted[node] = true
+	}
+	for node := range existing {
+		if wanted[node] {
+			continue
+		}
+		if _, err := a.Store.db.ExecContext(ctx, `DELETE FROM table_allocations WHERE node = ?`, node); err != nil {
+			return fmt.Errorf("release allocation for %s: %w", node, err)
+		}
+	}
+	return nil
+}
+
+// Allocations lists the persisted allocations.
+func (a *Allocator) Allocations(ctx context.Context) ([]TableAllocation, error) {
+	existing, err := queryAllocations(ctx, a.Store.db)
+	if err != nil {
+		return nil, err
+	}
+	allocs := make([]TableAllocation, 0, len(existing))
+	for _, alloc := range existing {
+		allocs = append(allocs, alloc)
+	}
+	sort.Slice(allocs, func(i, j int) bool { return allocs[i].TableID < allocs[j].TableID })
+	return allocs, nil
+}
+
+type allocQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+func queryAllocations(ctx context.Context, q allocQueryer) (map[string]TableAllocation, error) {
+	rows, err := q.QueryContext(ctx, `SELECT node, table_id, mark FROM table_allocations`)
+	if err != nil {
+		return nil, fmt.Errorf("load allocations: %w", err)
+	}
+	defer rows.Close()
+	allocs := make(map[string]TableAllocation)
+	for rows.Next() {
+		var alloc TableAllocation
+		if err := rows.Scan(&alloc.Node, &alloc.TableID, &alloc.Mark); err != nil {
+			return nil, fmt.Errorf("load allocations: %w", err)
+		}
+		allocs[alloc.Node] = alloc
+	}
+	return allocs, rows.Err()
+}
+
+func firstFree(min, max int, used, host map[int]bool) (int, bool) {
+	for id := min; id <= max; id++ {
+		if !used[id] && !host[id] {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// hostUsage reports the route tables and fwmarks in use on the host, from
+// the routing tables, ip rules and nftables mark statements.
+func hostUsage(ctx context.Context) (tables, marks map[int]bool, err error) {
+	tables, marks = make(map[int]bool), make(map[int]bool)
+	for _, family := range ipFamilies() {
+		routes, err := output(ctx, "ip", family, "route", "show", "table", "all")
+		if err != nil {
+			return nil, nil, fmt.Errorf("inspect host route tables: %w", err)
+		}
+		for _, line := range strings.Split(routes, "\n") {
+			if v, ok := fieldAfter(line, "table"); ok {
+				if id, err := strconv.Atoi(v); err == nil {
+					tables[id] = true
+				}
+			}
+		}
+		rules, err := liveIPRules(ctx, family)
+		if err != nil {
+			return nil, nil, fmt.Errorf("inspect host ip rules: %w", err)
+		}
+		for rule := range rules {
+			marks[rule[0]] = true
+			tables[rule[1]] = true
+		}
+	}
+	// nft is optional on a host that has never loaded a ruleset.
+	if ruleset, err := output(ctx, "nft", "list", "ruleset"); err == nil {
+		fields := strings.Fields(ruleset)
+		for i := 0; i+2 < len(fields); i++ {
+			if fields[i] == "mark" && fields[i+1] == "set" {
+				if v, err := strconv.ParseInt(fields[i+2], 0, 64); err == nil {
+					marks[int(v)] = true
+				}
+			}
+		}
+	}
+	return tables, marks, nil
+}
+
+func fieldAfter(line, key string) (string, bool) {
+	fields := strings.Fields(line)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == key {
+			return fields[i+1], true
+		}
+	}
+	return "", false
+}
+
+// migrateTableAllocations seeds allocations from the saved state so nodes
+// keep the index-based tables they were given before the allocator existed.
+func migrateTableAllocations(ctx context.Context, tx *sql.Tx) error {
+	if _, err := tx.ExecContext(ctx, `
+    CREATE TABLE IF NOT EXISTS table_allocations (
+        node TEXT PRIMARY KEY,
+        table_id INTEGER NOT NULL UNIQUE,
+        mark INTEGER NOT NULL UNIQUE,
+        allocated_at DATETIME NOT NULL
+    );
+    `); err != nil {
+		return err
+	}
+	var payload string
+	err := tx.QueryRowContext(ctx, `SELECT payload FROM routing_state WHERE id = 1`).Scan(&payload)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state RoutingState
+	if err := json.Unmarshal([]byte(payload), &state); err != nil {
+		return fmt.Errorf("decode saved state: %w", err)
+	}
+	for _, node := range state.Nodes {
+		mark := node.Mark
+		if mark == 0 {
+			mark = node.TableID
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO table_allocations (node, table_id, mark, allocated_at) VALUES (?, ?, ?, ?)`,
+			node.Name, node.TableID, mark, time.Now().UTC()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
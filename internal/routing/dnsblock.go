@@ -0,0 +1,103 @@
+package routing
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// Answers the DNS proxy gives for names a deny policy blocks.
+const (
+	// BlockNXDomain answers that the name does not exist.
+	BlockNXDomain = "nxdomain"
+	// BlockNullAddress answers A queries with 0.0.0.0 and AAAA queries
+	// with ::, and other types with no records.
+	BlockNullAddress = "null"
+	// BlockRefused refuses the query.
+	BlockRefused = "refused"
+)
+
+// blockTTL is the TTL of null-address answers.
+const blockTTL = 60
+
+func validBlockResponse(mode string) error {
+	switch mode {
+	case "", BlockNXDomain, BlockNullAddress, BlockRefused:
+		return nil
+	}
+	return fmt.Errorf("unknown block response %q", mode)
+}
+
+// blockingPolicy returns the deny policy that blocks r's question, if any.
+// The most specific policy domain decides, so an allow policy for a name
+// below a denied domain still lets it through.
+func (p *DNSProxy) blockingPolicy(r *dns.Msg) (string, bool) {
+	if len(r.Question) == 0 {
+		return "", false
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.denied) == 0 || p.domains == nil {
+		return "", false
+	}
+	policy, ok := p.domains.Lookup(r.Question[0].Name)
+	if !ok || !p.denied[policy] {
+		return "", false
+	}
+	return policy, true
+}
+
+// block answers r for a name policy denies without asking upstream.
+func (p *DNSProxy) block(w dns.ResponseWriter, r *dns.Msg, policy string) {
+	resp := new(dns.Msg)
+	q := r.Question[0]
+	switch p.BlockResponse {
+	case BlockRefused:
+		resp.SetRcode(r, dns.RcodeRefused)
+	case BlockNullAddress:
+		resp.SetReply(r)
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: q.Qclass, Ttl: blockTTL}
+		switch q.Qtype {
+		case dns.TypeA:
+			resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: net.IPv4zero})
+		case dns.TypeAAAA:
+			resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero})
+		}
+	default:
+		resp.SetRcode(r, dns.RcodeNameError)
+	}
+	resp.RecursionAvailable = true
+
+	p.blockMu.Lock()
+	if p.blocked == nil {
+		p.blocked = make(map[string]uint64)
+	}
+	p.blocked[policy]++
+	p.blockMu.Unlock()
+	log.Printf("dns: blocked %s %s for %s (policy %s)", dns.TypeToString[q.Qtype], q.Name, w.RemoteAddr(), policy)
+	_ = w.WriteMsg(resp)
+}
+
+// resetBlockCounts drops the counters of policies that no longer deny.
+func (p *DNSProxy) resetBlockCounts(denied map[string]bool) {
+	p.blockMu.Lock()
+	defer p.blockMu.Unlock()
+	for policy := range p.blocked {
+		if !denied[policy] {
+			delete(p.blocked, policy)
+		}
+	}
+}
+
+// BlockCounts returns the number of queries each deny policy has blocked.
+func (p *DNSProxy) BlockCounts() map[string]uint64 {
+	p.blockMu.Lock()
+	defer p.blockMu.Unlock()
+	counts := make(map[string]uint64, len(p.blocked))
+	for policy, n := range p.blocked {
+		counts[policy] = n
+	}
+	return counts
+}
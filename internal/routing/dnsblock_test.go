@@ -0,0 +1,139 @@
+package routing
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startBlockingProxy runs a proxy with a deny policy for ads.example.com,
+// an allow policy carving out ok.ads.example.com, and an upstream that
+// counts the queries it sees.
+func startBlockingProxy(t *testing.T, mode string) (*DNSProxy, string, *atomic.Int32) {
+	t.Helper()
+	var queries atomic.Int32
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		standInHandler(w, r)
+	})}
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = server.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = server.Shutdown() })
+
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen := l.LocalAddr().String()
+	_ = l.Close()
+	proxy := &DNSProxy{ListenAddr: listen, Upstream: pc.LocalAddr().String(), BlockResponse: mode}
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+	policies := []PolicyStatus{
+		{PolicyGroup: PolicyGroup{Name: "ads", Domains: []string{"ads.example.com"}, Action: ActionDeny}},
+		{PolicyGroup: PolicyGroup{Name: "carve-out", Domains: []string{"ok.ads.example.com"}, Action: ActionAllow}},
+	}
+	if err := proxy.UpdatePolicies(policies, nil); err != nil {
+		t.Fatal(err)
+	}
+	return proxy, listen, &queries
+}
+
+func ask(t *testing.T, addr, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	client := &dns.Client{Timeout: time.Second}
+	var (
+		resp *dns.Msg
+		err  error
+	)
+	for i := 0; i < 20; i++ {
+		if resp, _, err = client.Exchange(msg, addr); err == nil {
+			return resp
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("%s: %v", name, err)
+	return nil
+}
+
+func TestDNSProxyBlocksDenyPolicies(t *testing.T) {
+	for _, tc := range []struct {
+		mode  string
+		rcode int
+		addr  string
+	}{
+		{"", dns.RcodeNameError, ""},
+		{BlockNXDomain, dns.RcodeNameError, ""},
+		{BlockRefused, dns.RcodeRefused, ""},
+		{BlockNullAddress, dns.RcodeSuccess, "0.0.0.0"},
+	} {
+		proxy, addr, queries := startBlockingProxy(t, tc.mode)
+		resp := ask(t, addr, "tracker.ads.example.com.", dns.TypeA)
+		if resp.Rcode != tc.rcode {
+			t.Errorf("mode %q: rcode %s, want %s", tc.mode, dns.RcodeToString[resp.Rcode], dns.RcodeToString[tc.rcode])
+		}
+		if tc.addr != "" && (len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != tc.addr) {
+			t.Errorf("mode %q: answer %v, want %s", tc.mode, resp.Answer, tc.addr)
+		}
+		if tc.addr == "" && len(resp.Answer) != 0 {
+			t.Errorf("mode %q: unexpected answer %v", tc.mode, resp.Answer)
+		}
+		if got := queries.Load(); got != 0 {
+			t.Errorf("mode %q: blocked query reached the upstream", tc.mode)
+		}
+
+		// The more specific allow policy wins below the denied domain.
+		if resp := ask(t, addr, "ok.ads.example.com.", dns.TypeA); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+			t.Errorf("mode %q: carve-out answered %v", tc.mode, resp)
+		}
+		if got := proxy.BlockCounts()["ads"]; got != 1 {
+			t.Errorf("mode %q: ads blocked %d queries, want 1", tc.mode, got)
+		}
+	}
+}
+
+func TestDNSProxyNullAddressAAAA(t *testing.T) {
+	_, addr, _ := startBlockingProxy(t, BlockNullAddress)
+	resp := ask(t, addr, "ads.example.com.", dns.TypeAAAA)
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.AAAA).AAAA.String() != "::" {
+		t.Errorf("answer %v, want ::", resp.Answer)
+	}
+	if resp := ask(t, addr, "ads.example.com.", dns.TypeMX); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+		t.Errorf("MX answer %v, want an empty answer", resp)
+	}
+}
+
+func TestDNSProxyRejectsUnknownBlockResponse(t *testing.T) {
+	proxy := &DNSProxy{ListenAddr: "127.0.0.1:0", BlockResponse: "drop"}
+	if err := proxy.Start(); err == nil {
+		_ = proxy.Stop(context.Background())
+		t.Fatal("unknown block response accepted")
+	}
+}
+
+func TestDenyPoliciesHaveNoDNSSets(t *testing.T) {
+	policies := []PolicyStatus{
+		{PolicyGroup: PolicyGroup{Name: "ads", Domains: []string{"ads.example.com"}, Action: ActionDeny}, Mark: 101},
+		{PolicyGroup: PolicyGroup{Name: "video", Domains: []string{"video.example.com"}}, Mark: 101},
+	}
+	if sets := domainSets(policies); len(sets) != 2 || sets[0] != "dns_video" || sets[1] != "dns6_video" {
+		t.Errorf("domainSets = %v", sets)
+	}
+	if rules := policyRules(policies[0]); len(rules) != 0 {
+		t.Errorf("deny policy rendered rules %v", rules)
+	}
+}
@@ -0,0 +1,234 @@
+package routing
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxNegativeTTL caps how long NXDOMAIN and NODATA answers are cached.
+	maxNegativeTTL = 5 * time.Minute
+	// staleAnswerTTL is the TTL of answers served past their expiry
+	// (RFC 8767 recommends 30 seconds).
+	staleAnswerTTL = 30
+	// A cached answer is prefetched when it has been hit prefetchMinHits
+	// times and less than a tenth of its TTL is left. Answers with TTLs under
+	// prefetchMinTTL are left to expire.
+	prefetchMinHits = 3
+	prefetchMinTTL  = 10 * time.Second
+)
+
+// CacheStatus reports the DNS response cache.
+type CacheStatus struct {
+	Entries     int    `json:"entries"`
+	Capacity    int    `json:"capacity"`
+	Hits        uint64 `json:"hits"`
+	Misses      uint64 `json:"misses"`
+	StaleServed uint64 `json:"staleServed"`
+	Prefetches  uint64 `json:"prefetches"`
+}
+
+// dnsCache is an LRU cache of upstream responses keyed by question. Expired
+// entries are kept for staleFor so they can be served when every upstream
+// fails.
+type dnsCache struct {
+	capacity int
+	staleFor time.Duration
+	prefetch bool
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	status  CacheStatus
+}
+
+type cacheEntry struct {
+	key         string
+	msg         *dns.Msg
+	stored      time.Time
+	ttl         time.Duration
+	hits        int
+	prefetching bool
+}
+
+func newDNSCache(capacity int, staleFor time.Duration, prefetch bool) *dnsCache {
+	return &dnsCache{
+		capacity: capacity,
+		staleFor: staleFor,
+		prefetch: prefetch,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// cacheKey identifies the answer to query. Only single-question queries
+// are cached.
+func cacheKey(query *dns.Msg) (string, bool) {
+	if len(query.Question) != 1 {
+		return "", false
+	}
+	q := query.Question[0]
+	do := false
+	if opt := query.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	return fmt.Sprintf("%s|%d|%d|%t|%t", strings.ToLower(q.Name), q.Qtype, q.Qclass, do, query.CheckingDisabled), true
+}
+
+// cacheTTL returns how long resp may be cached. Answers live for their
+// lowest record TTL; NXDOMAIN and NODATA for the SOA minimum (RFC 2308).
+// Truncated answers and other rcodes are not cached.
+func cacheTTL(resp *dns.Msg) (time.Duration, bool) {
+	if resp.Truncated {
+		return 0, false
+	}
+	switch {
+	case resp.Rcode == dns.RcodeSuccess && len(resp.Answer) > 0:
+		ttl := resp.Answer[0].Header().Ttl
+		for _, rr := range resp.Answer[1:] {
+			ttl = min(ttl, rr.Header().Ttl)
+		}
+		return time.Duration(ttl) * time.Second, ttl > 0
+	case resp.Rcode == dns.RcodeSuccess, resp.Rcode == dns.RcodeNameError:
+		for _, rr := range resp.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl := min(time.Duration(min(soa.Hdr.Ttl, soa.Minttl))*time.Second, maxNegativeTTL)
+				return ttl, ttl > 0
+			}
+		}
+	}
+	return 0, false
+}
+
+// Get returns a fresh cached answer with its TTLs counted down. prefetch
+// reports that the caller should refresh the entry ahead of its expiry.
+func (c *dnsCache) Get(key string) (resp *dns.Msg, prefetch, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, found := c.entries[key]
+	if !found {
+		c.status.Misses++
+		return nil, false, false
+	}
+	entry := el.Value.(*cacheEntry)
+	age := time.Since(entry.stored)
+	if age >= entry.ttl {
+		if age >= entry.ttl+c.staleFor {
+			c.remove(el)
+		}
+		c.status.Misses++
+		return nil, false, false
+	}
+	c.lru.MoveToFront(el)
+	c.status.Hits++
+	entry.hits++
+	if c.prefetch && !entry.prefetching && entry.hits >= prefetchMinHits &&
+		entry.ttl >= prefetchMinTTL && entry.ttl-age < entry.ttl/10 {
+		entry.prefetching = true
+		c.status.Prefetches++
+		prefetch = true
+	}
+	return agedCopy(entry.msg, uint32(age/time.Second)), prefetch, true
+}
+
+// prefetchDone lets the entry under key be prefetched again. Prefetches
+// that fail or return an uncacheable answer leave the old entry in place,
+// which would otherwise never be refreshed early again.
+func (c *dnsCache) prefetchDone(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, found := c.entries[key]; found {
+		el.Value.(*cacheEntry).prefetching = false
+	}
+}
+
+// Stale returns an expired answer still within the serve-stale window,
+// with its TTLs set to staleAnswerTTL.
+func (c *dnsCache) Stale(key string) (*dns.Msg, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, found := c.entries[key]
+	if !found {
+		return nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Since(entry.stored) >= entry.ttl+c.staleFor {
+		return nil, false
+	}
+	c.status.StaleServed++
+	resp := entry.msg.Copy()
+	forEachRR(resp, func(hdr *dns.RR_Header) { hdr.Ttl = staleAnswerTTL })
+	return resp, true
+}
+
+// Put caches a copy of resp if it is cacheable.
+func (c *dnsCache) Put(key string, resp *dns.Msg) {
+	ttl, ok := cacheTTL(resp)
+	if !ok {
+		return
+	}
+	entry := &cacheEntry{key: key, msg: resp.Copy(), stored: time.Now(), ttl: ttl}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, found := c.entries[key]; found {
+		el.Value = entry
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.capacity {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Flush drops every entry.
+func (c *dnsCache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+func (c *dnsCache) Status() CacheStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status := c.status
+	status.Entries = c.lru.Len()
+	status.Capacity = c.capacity
+	return status
+}
+
+func (c *dnsCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+}
+
+// agedCopy copies msg with every record TTL reduced by age seconds.
+func agedCopy(msg *dns.Msg, age uint32) *dns.Msg {
+	resp := msg.Copy()
+	forEachRR(resp, func(hdr *dns.RR_Header) {
+		if hdr.Ttl > age {
+			hdr.Ttl -= age
+		} else {
+			hdr.Ttl = 0
+		}
+	})
+	return resp
+}
+
+// forEachRR calls fn with the header of every record except OPT, whose TTL
+// field carries EDNS flags.
+func forEachRR(msg *dns.Msg, fn func(*dns.RR_Header)) {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if _, ok := rr.(*dns.OPT); !ok {
+				fn(rr.Header())
+			}
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package routing
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func answer(name string, ttl uint32) *dns.Msg {
+	query := new(dns.Msg)
+	query.SetQuestion(name, dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(query)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   net.ParseIP("192.0.2.1"),
+	}}
+	return resp
+}
+
+func nxdomain(name string, soaTTL, minTTL uint32) *dns.Msg {
+	query := new(dns.Msg)
+	query.SetQuestion(name, dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetRcode(query, dns.RcodeNameError)
+	resp.Ns = []dns.RR{&dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: soaTTL},
+		Ns:     "ns.example.com.",
+		Mbox:   "hostmaster.example.com.",
+		Minttl: minTTL,
+	}}
+	return resp
+}
+
+func TestCacheTTL(t *testing.T) {
+	servfail := answer("a.example.com.", 300)
+	servfail.Rcode = dns.RcodeServerFailure
+	truncated := answer("a.example.com.", 300)
+	truncated.Truncated = true
+	for name, tc := range map[string]struct {
+		resp *dns.Msg
+		ttl  time.Duration
+		ok   bool
+	}{
+		"answer":            {answer("a.example.com.", 300), 300 * time.Second, true},
+		"nxdomain":          {nxdomain("b.example.com.", 3600, 60), 60 * time.Second, true},
+		"nxdomain capped":   {nxdomain("b.example.com.", 86400, 86400), maxNegativeTTL, true},
+		"nxdomain, no soa":  {nxdomain("b.example.com.", 0, 0), 0, false},
+		"servfail":          {servfail, 0, false},
+		"truncated":         {truncated, 0, false},
+		"zero ttl answer":   {answer("a.example.com.", 0), 0, false},
+		"nodata with a soa": {func() *dns.Msg { m := nxdomain("c.example.com.", 120, 900); m.Rcode = dns.RcodeSuccess; return m }(), 120 * time.Second, true},
+	} {
+		ttl, ok := cacheTTL(tc.resp)
+		if ok != tc.ok || (ok && ttl != tc.ttl) {
+			t.Errorf("%s: cacheTTL = %s, %t; want %s, %t", name, ttl, ok, tc.ttl, tc.ok)
+		}
+	}
+}
+
+func TestCacheCountsDownTTLs(t *testing.T) {
+	cache := newDNSCache(10, 0, false)
+	cache.Put("k", answer("a.example.com.", 300))
+	cache.entries["k"].Value.(*cacheEntry).stored = time.Now().Add(-100 * time.Second)
+	resp, _, ok := cache.Get("k")
+	if !ok {
+		t.Fatal("miss")
+	}
+	if ttl := resp.Answer[0].Header().Ttl; ttl != 200 {
+		t.Errorf("ttl = %d, want 200", ttl)
+	}
+	// The returned message is a copy.
+	resp.Answer[0].Header().Ttl = 1
+	if again, _, _ := cache.Get("k"); again.Answer[0].Header().Ttl != 200 {
+		t.Error("Get returned the cached message itself")
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newDNSCache(2, 0, false)
+	cache.Put("a", answer("a.example.com.", 300))
+	cache.Put("b", answer("b.example.com.", 300))
+	cache.Get("a")
+	cache.Put("c", answer("c.example.com.", 300))
+	if _, _, ok := cache.Get("b"); ok {
+		t.Error("least recently used entry kept")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, _, ok := cache.Get(key); !ok {
+			t.Errorf("entry %s evicted", key)
+		}
+	}
+	if status := cache.Status(); status.Entries != 2 || status.Capacity != 2 {
+		t.Errorf("status = %+v", status)
+	}
+}
+
+func TestCacheServesStale(t *testing.T) {
+	cache := newDNSCache(10, time.Hour, false)
+	cache.Put("k", answer("a.example.com.", 60))
+	entry := cache.entries["k"].Value.(*cacheEntry)
+	entry.stored = time.Now().Add(-2 * time.Minute)
+	if _, _, ok := cache.Get("k"); ok {
+		t.Fatal("expired entry served as fresh")
+	}
+	stale, ok := cache.Stale("k")
+	if !ok || stale.Answer[0].Header().Ttl != staleAnswerTTL {
+		t.Fatalf("Stale = %v, %t", stale, ok)
+	}
+	entry.stored = time.Now().Add(-2 * time.Hour)
+	if _, ok := cache.Stale("k"); ok {
+		t.Error("entry served past the stale window")
+	}
+}
+
+func TestCachePrefetchesPopularEntries(t *testing.T) {
+	cache := newDNSCache(10, 0, true)
+	cache.Put("k", answer("a.example.com.", 100))
+	cache.entries["k"].Value.(*cacheEntry).stored = time.Now().Add(-95 * time.Second)
+	prefetches := 0
+	for i := 0; i < 5; i++ {
+		if _, prefetch, _ := cache.Get("k"); prefetch {
+			prefetches++
+		}
+	}
+	if prefetches != 1 {
+		t.Errorf("prefetch requested %d times, want once", prefetches)
+	}
+	// A failed prefetch leaves the entry in place; it must be retried.
+	cache.prefetchDone("k")
+	if _, prefetch, _ := cache.Get("k"); !prefetch {
+		t.Error("prefetch not requested again after a failed prefetch")
+	}
+}
+
+func TestDNSProxyCachesAndServesStale(t *testing.T) {
+	var queries atomic.Int32
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		standInHandler(w, r)
+	})}
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = server.ActivateAndServe() }()
+	<-started
+
+	proxy := &DNSProxy{ListenAddr: "127.0.0.1:0", Upstream: pc.LocalAddr().String(), CacheSize: 10, ServeStale: time.Hour}
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Stop(context.Background())
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	for i := 0; i < 3; i++ {
+		if _, err := proxy.resolve(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := queries.Load(); got != 1 {
+		t.Errorf("upstream saw %d queries, want 1", got)
+	}
+
+	// Expire the entry and take the upstream away.
+	for _, el := range proxy.cache.entries {
+		el.Value.(*cacheEntry).stored = time.Now().Add(-10 * time.Minute)
+	}
+	_ = server.Shutdown()
+	resp, err := proxy.resolve(msg)
+	if err != nil {
+		t.Fatalf("stale answer not served: %v", err)
+	}
+	if resp.Answer[0].Header().Ttl != staleAnswerTTL {
+		t.Errorf("stale ttl = %d", resp.Answer[0].Header().Ttl)
+	}
+	if status := proxy.cache.Status(); status.Hits != 2 || status.StaleServed != 1 {
+		t.Errorf("cache status = %+v", status)
+	}
+}
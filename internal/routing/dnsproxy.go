@@ -2,8 +2,12 @@ package routing
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"log"
 	"net"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -11,15 +15,68 @@ import (
 	"github.com/miekg/dns"
 )
 
+// Default bounds on how long a DNS-learned address stays in a policy set.
+const (
+	DefaultMinTTL = time.Minute
+	DefaultMaxTTL = time.Hour
+)
+
 type DNSProxy struct {
 	ListenAddr string
-	Upstream   string
-	NFT        *NFTManager
+	// Upstream is the resolver URI; see ParseUpstream. It is used when
+	// Upstreams is empty.
+	Upstream string
+	// Upstreams lists several resolver URIs, picked per query according to
+	// Strategy (StrategyFailover when empty). Upstreams that keep failing
+	// are marked down and probed every HealthInterval until they answer.
+	Upstreams      []string
+	Strategy       string
+	HealthInterval time.Duration
+	// TLSConfig is used for tls:// and https:// upstreams; the system roots
+	// are trusted when nil.
+	TLSConfig *tls.Config
+	NFT       *NFTManager
+	// MinTTL and MaxTTL clamp the answer TTL used as the set element
+	// timeout, so short TTLs don't drop addresses mid-session and long ones
+	// don't pin addresses a CDN has since reassigned.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// WaitForSets holds each reply until its addresses are in the nft sets,
+	// so the client's first connection is already marked. Otherwise replies
+	// go out immediately and the sets catch up a batch window later.
+	WaitForSets bool
+	// BatchWindow is how long learned addresses are coalesced before being
+	// written; DefaultBatchWindow when zero.
+	BatchWindow time.Duration
+	// CacheSize bounds the response cache in entries; zero disables it.
+	// Expired answers are kept for ServeStale and served when the upstreams
+	// fail. With Prefetch, popular answers are refreshed before they expire.
+	CacheSize  int
+	ServeStale time.Duration
+	Prefetch   bool
+	// BlockResponse is how names of deny policies are answered:
+	// BlockNXDomain (the default), BlockNullAddress or BlockRefused.
+	BlockResponse string
+
+	mu        sync.RWMutex
+	domains   *domainTrie
+	upstreams *upstreamPool
+	servers   []*dns.Server
+	started   bool
+	writer    *setWriter
+	cache     *dnsCache
+	stop      context.CancelFunc
+
+	resolvers     map[string]*policyResolver
+	stopResolvers context.CancelFunc
+	denied        map[string]bool
+	learning      map[string]bool
 
-	mu       sync.RWMutex
-	policies map[string]string
-	server   *dns.Server
-	started  bool
+	blockMu sync.Mutex
+	blocked map[string]uint64
+
+	attrMu       sync.Mutex
+	attributions map[string]Attribution
 }
 
 func (p *DNSProxy) Start() error {
@@ -31,83 +88,387 @@ func (p *DNSProxy) Start() error {
 	if p.ListenAddr == "" {
 		p.ListenAddr = "127.0.0.1:5353"
 	}
-	if p.Upstream == "" {
-		p.Upstream = "1.1.1.1:53"
+	if err := validBlockResponse(p.BlockResponse); err != nil {
+		return fmt.Errorf("dns: %w", err)
+	}
+	upstreams, err := newUpstreamPool(p.upstreamURIs(), p.Strategy, UpstreamOptions{TLSConfig: p.TLSConfig})
+	if err != nil {
+		return fmt.Errorf("dns: %w", err)
+	}
+	p.upstreams = upstreams
+	if p.CacheSize > 0 {
+		p.cache = newDNSCache(p.CacheSize, p.ServeStale, p.Prefetch)
 	}
-	if p.policies == nil {
-		p.policies = make(map[string]string)
+	if p.domains == nil {
+		p.domains = newDomainTrie()
 	}
 	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
 		p.handleQuery(w, r)
 	})
-	p.server = &dns.Server{
-		Addr:    p.ListenAddr,
-		Net:     "udp",
-		Handler: handler,
+	p.servers = []*dns.Server{
+		{Addr: p.ListenAddr, Net: "udp", Handler: handler},
+		{Addr: p.ListenAddr, Net: "tcp", Handler: handler},
+	}
+	var ctx context.Context
+	ctx, p.stop = context.WithCancel(context.Background())
+	go upstreams.Run(ctx, p.HealthInterval)
+	if p.NFT != nil {
+		p.writer = newSetWriter(p.NFT, p.BatchWindow)
+		go p.writer.Run(ctx)
 	}
 	p.started = true
-	go func() {
-		_ = p.server.ListenAndServe()
-	}()
+	for _, server := range p.servers {
+		server := server
+		go func() {
+			if err := server.ListenAndServe(); err != nil {
+				log.Printf("dns: %s listener on %s: %v", server.Net, server.Addr, err)
+			}
+		}()
+	}
 	return nil
 }
 
-func (p *DNSProxy) UpdatePolicies(policies []PolicyStatus) {
+// UpdatePolicies replaces the policy domains and per-policy resolvers.
+// nodes are the egress nodes the policies' resolvers send queries through.
+func (p *DNSProxy) UpdatePolicies(policies []PolicyStatus, nodes []NodeStatus) error {
+	resolvers, err := p.newPolicyResolvers(policies, nodes)
+	if err != nil {
+		return err
+	}
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	if p.policies == nil {
-		p.policies = make(map[string]string)
-	}
-	for k := range p.policies {
-		delete(p.policies, k)
-	}
+	domains := newDomainTrie()
+	denied := make(map[string]bool)
+	learning := make(map[string]bool)
 	for _, policy := range policies {
 		for _, domain := range policy.Domains {
-			p.policies[normalizeDomain(domain)] = policy.Name
+			domains.Insert(domain, policy.Name)
+		}
+		if policy.Action == ActionDeny && len(policy.Domains) > 0 {
+			denied[policy.Name] = true
 		}
+		if learnsDomains(policy.PolicyGroup) {
+			learning[policy.Name] = true
+		}
+	}
+	p.domains = domains
+	p.denied = denied
+	p.learning = learning
+	p.resetBlockCounts(denied)
+	p.setPolicyResolvers(resolvers)
+	// Cached answers may come from resolvers the policies no longer use.
+	if p.cache != nil {
+		p.cache.Flush()
 	}
+	return nil
 }
 
+// upstreamUDPSize is the EDNS0 buffer size advertised upstream, the value
+// recommended to avoid IP fragmentation.
+const upstreamUDPSize = 1232
+
 func (p *DNSProxy) handleQuery(w dns.ResponseWriter, r *dns.Msg) {
-	client := &dns.Client{Timeout: 5 * time.Second}
-	resp, _, err := client.Exchange(r, p.Upstream)
+	if policy, ok := p.blockingPolicy(r); ok {
+		p.block(w, r, policy)
+		return
+	}
+	_, overTCP := w.RemoteAddr().(*net.TCPAddr)
+	resp, err := p.resolve(r)
 	if err != nil {
-		_ = w.WriteMsg(&dns.Msg{
-			MsgHdr: dns.MsgHdr{Rcode: dns.RcodeServerFailure},
-		})
+		servfail := new(dns.Msg)
+		servfail.SetRcode(r, dns.RcodeServerFailure)
+		_ = w.WriteMsg(servfail)
 		return
 	}
+	// Cached answers are tracked too, so their addresses stay in the sets.
 	p.trackAnswers(resp)
+	if r.IsEdns0() == nil {
+		stripOPT(resp)
+	}
+	resp.Id = r.Id
+	if !overTCP {
+		size := dns.MinMsgSize
+		if opt := r.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		resp.Truncate(size)
+	}
 	_ = w.WriteMsg(resp)
 }
 
-func (p *DNSProxy) trackAnswers(resp *dns.Msg) {
+// resolve answers r from the cache or upstream. Queries are sent with an
+// EDNS0 OPT record so large answers fit in UDP; the caller strips it again
+// for clients that did not send one. The reply is the caller's to modify.
+func (p *DNSProxy) resolve(r *dns.Msg) (*dns.Msg, error) {
+	query := r.Copy()
+	if query.IsEdns0() == nil {
+		query.SetEdns0(upstreamUDPSize, false)
+	}
 	p.mu.RLock()
-	defer p.mu.RUnlock()
-	if len(p.policies) == 0 || p.NFT == nil {
+	cache := p.cache
+	p.mu.RUnlock()
+	key, cacheable := "", false
+	if cache != nil {
+		key, cacheable = cacheKey(query)
+	}
+	if cacheable {
+		if resp, prefetch, ok := cache.Get(key); ok {
+			if prefetch {
+				go p.prefetch(cache, key, query)
+			}
+			return resp, nil
+		}
+	}
+	resp, err := p.exchange(query)
+	if !cacheable {
+		return resp, err
+	}
+	if err != nil || resp.Rcode == dns.RcodeServerFailure {
+		if stale, ok := cache.Stale(key); ok {
+			return stale, nil
+		}
+		return resp, err
+	}
+	cache.Put(key, resp)
+	return resp, nil
+}
+
+// prefetch refreshes a popular cache entry before it expires.
+func (p *DNSProxy) prefetch(cache *dnsCache, key string, query *dns.Msg) {
+	defer cache.prefetchDone(key)
+	resp, err := p.exchange(query)
+	if err != nil {
 		return
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	cache.Put(key, resp)
+	p.trackAnswers(resp)
+}
+
+// exchange forwards query upstream, to the resolver of the policy matching
+// the question if it has one.
+func (p *DNSProxy) exchange(query *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
 	defer cancel()
+	return p.upstreamFor(query).Exchange(ctx, query)
+}
+
+func stripOPT(msg *dns.Msg) {
+	extra := msg.Extra[:0]
+	for _, rr := range msg.Extra {
+		if _, ok := rr.(*dns.OPT); !ok {
+			extra = append(extra, rr)
+		}
+	}
+	msg.Extra = extra
+}
+
+// Attribution records how a DNS-learned address came to be in a policy set:
+// the question asked and the CNAME chain followed to the record's owner.
+type Attribution struct {
+	Address  string    `json:"address"`
+	Policy   string    `json:"policy"`
+	Question string    `json:"question"`
+	Chain    []string  `json:"chain,omitempty"`
+	Expires  time.Time `json:"expires"`
+}
+
+// maxAttributions bounds the attribution log; the entries closest to
+// expiry are dropped first.
+const maxAttributions = 4096
+
+// maxCNAMEHops bounds CNAME chain walks against looping responses.
+const maxCNAMEHops = 16
+
+// trackAnswers adds the addresses in resp to the sets of the policies they
+// belong to. An address reached through CNAMEs is attributed to the first
+// name along the chain, starting from the question, that a policy matches.
+func (p *DNSProxy) trackAnswers(resp *dns.Msg) {
+	p.mu.RLock()
+	domains, writer, learning := p.domains, p.writer, p.learning
+	p.mu.RUnlock()
+	if domains == nil || domains.Len() == 0 || writer == nil {
+		return
+	}
+	var wg sync.WaitGroup
+	defer func() {
+		if p.WaitForSets {
+			waitTimeout(&wg, 2*time.Second)
+		}
+	}()
+	chains := cnameChains(resp)
 	for _, answer := range resp.Answer {
+		var ip string
 		switch rr := answer.(type) {
 		case *dns.A:
-			p.addIP(rr.Hdr.Name, rr.A.String(), ctx)
+			ip = rr.A.String()
 		case *dns.AAAA:
-			p.addIP(rr.Hdr.Name, rr.AAAA.String(), ctx)
+			ip = rr.AAAA.String()
+		default:
+			continue
+		}
+		owner := normalizeDomain(answer.Header().Name)
+		chain, ok := chains[owner]
+		if !ok {
+			chain = []string{owner}
+		}
+		for _, name := range chain {
+			if policy, ok := domains.Lookup(name); ok {
+				// Deny policies have no sets to fill.
+				if !learning[policy] {
+					break
+				}
+				wg.Add(1)
+				p.addIP(writer, policy, ip, chain, p.elementTimeout(answer.Header().Ttl), wg.Done)
+				break
+			}
 		}
 	}
 }
 
-func (p *DNSProxy) addIP(name string, ip string, ctx context.Context) {
-	policyName, ok := p.policies[normalizeDomain(name)]
-	if !ok {
-		return
+// cnameChains maps every name reachable from the question through the
+// response's CNAME records to the chain of names leading to it, question
+// first.
+func cnameChains(resp *dns.Msg) map[string][]string {
+	if len(resp.Question) == 0 {
+		return nil
 	}
-	if net.ParseIP(ip) == nil {
-		return
+	targets := make(map[string]string)
+	for _, answer := range resp.Answer {
+		if rr, ok := answer.(*dns.CNAME); ok {
+			targets[normalizeDomain(rr.Hdr.Name)] = normalizeDomain(rr.Target)
+		}
+	}
+	name := normalizeDomain(resp.Question[0].Name)
+	chain := []string{name}
+	chains := map[string][]string{name: chain}
+	for i := 0; i < maxCNAMEHops; i++ {
+		target, ok := targets[name]
+		if !ok {
+			break
+		}
+		if _, seen := chains[target]; seen {
+			break
+		}
+		chain = append(chain[:len(chain):len(chain)], target)
+		chains[target] = chain
+		name = target
+	}
+	return chains
+}
+
+func (p *DNSProxy) ttlBounds() (minTTL, maxTTL time.Duration) {
+	minTTL, maxTTL = p.MinTTL, p.MaxTTL
+	if minTTL <= 0 {
+		minTTL = DefaultMinTTL
+	}
+	if maxTTL <= 0 {
+		maxTTL = DefaultMaxTTL
+	}
+	return minTTL, maxTTL
+}
+
+// elementTimeout clamps an answer TTL to [MinTTL, MaxTTL].
+func (p *DNSProxy) elementTimeout(ttl uint32) time.Duration {
+	minTTL, maxTTL := p.ttlBounds()
+	timeout := time.Duration(ttl) * time.Second
+	if timeout < minTTL {
+		timeout = minTTL
+	}
+	if timeout > maxTTL {
+		timeout = maxTTL
+	}
+	return timeout
+}
+
+// addIP queues ip for policy's set and records its attribution once
+// written. done is called either way.
+func (p *DNSProxy) addIP(writer *setWriter, policy, ip string, chain []string, timeout time.Duration, done func()) {
+	attr := Attribution{
+		Address:  ip,
+		Policy:   policy,
+		Question: chain[0],
+		Expires:  time.Now().Add(timeout).UTC(),
 	}
-	_ = p.NFT.AddDomainIPs(ctx, policyName, []string{ip})
+	if len(chain) > 1 {
+		attr.Chain = chain[1:]
+	}
+	writer.Add(policy, ip, timeout, func(err error) {
+		if err == nil {
+			p.recordAttribution(attr)
+		}
+		done()
+	})
+}
+
+// waitTimeout waits for wg, giving up after timeout.
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) {
+	ch := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ch:
+	case <-timer.C:
+	}
+}
+
+func (p *DNSProxy) recordAttribution(attr Attribution) {
+	p.attrMu.Lock()
+	defer p.attrMu.Unlock()
+	if p.attributions == nil {
+		p.attributions = make(map[string]Attribution)
+	}
+	now := time.Now()
+	key := attr.Policy + " " + attr.Address
+	if _, ok := p.attributions[key]; !ok && len(p.attributions) >= maxAttributions {
+		oldest := ""
+		for k, a := range p.attributions {
+			if a.Expires.Before(now) {
+				delete(p.attributions, k)
+				continue
+			}
+			if oldest == "" || a.Expires.Before(p.attributions[oldest].Expires) {
+				oldest = k
+			}
+		}
+		if len(p.attributions) >= maxAttributions {
+			delete(p.attributions, oldest)
+		}
+	}
+	p.attributions[key] = attr
+}
+
+// Attributions lists the unexpired addresses learned from DNS answers and
+// the names that led to them.
+func (p *DNSProxy) Attributions() []Attribution {
+	p.attrMu.Lock()
+	defer p.attrMu.Unlock()
+	now := time.Now()
+	attrs := make([]Attribution, 0, len(p.attributions))
+	for key, attr := range p.attributions {
+		if attr.Expires.Before(now) {
+			delete(p.attributions, key)
+			continue
+		}
+		attrs = append(attrs, attr)
+	}
+	sort.Slice(attrs, func(i, j int) bool {
+		if attrs[i].Policy != attrs[j].Policy {
+			return attrs[i].Policy < attrs[j].Policy
+		}
+		return attrs[i].Address < attrs[j].Address
+	})
+	return attrs
+}
+
+func (p *DNSProxy) domainCount() int {
+	if p.domains == nil {
+		return 0
+	}
+	return p.domains.Len()
 }
 
 func normalizeDomain(domain string) string {
@@ -118,13 +479,28 @@ func normalizeDomain(domain string) string {
 func (p *DNSProxy) Stop(ctx context.Context) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	if !p.started || p.server == nil {
+	if !p.started || len(p.servers) == 0 {
 		return nil
 	}
 	p.started = false
+	if p.stop != nil {
+		p.stop()
+		p.stop, p.writer = nil, nil
+	}
+	if p.upstreams != nil {
+		_ = p.upstreams.Close()
+	}
+	p.setPolicyResolvers(nil)
 	shutdownCh := make(chan error, 1)
+	servers := p.servers
 	go func() {
-		shutdownCh <- p.server.Shutdown()
+		var errs []error
+		for _, server := range servers {
+			if err := server.Shutdown(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		shutdownCh <- errors.Join(errs...)
 	}()
 	select {
 	case err := <-shutdownCh:
@@ -139,10 +515,37 @@ func (p *DNSProxy) Status() map[string]any {
 	defer p.mu.RUnlock()
 	status := map[string]any{
 		"listenAddress": p.ListenAddr,
-		"upstream":      p.Upstream,
-		"policyCount":   len(p.policies),
+		"upstream":      p.upstreamURIs()[0],
+		"upstreams":     []UpstreamStatus{},
+		"policyCount":   p.domainCount(),
+		"learned":       len(p.Attributions()),
+		"waitForSets":   p.WaitForSets,
+	}
+	if p.upstreams != nil {
+		status["strategy"] = p.upstreams.strategy
+		status["upstream"] = p.upstreams.Primary()
+		status["upstreams"] = p.upstreams.Status()
+	}
+	status["resolvers"] = p.resolverStatus()
+	if p.cache != nil {
+		status["cache"] = p.cache.Status()
+	}
+	blockResponse := p.BlockResponse
+	if blockResponse == "" {
+		blockResponse = BlockNXDomain
+	}
+	status["blockResponse"] = blockResponse
+	blocked := p.BlockCounts()
+	for policy := range p.denied {
+		if _, ok := blocked[policy]; !ok {
+			blocked[policy] = 0
+		}
 	}
-	if p.server == nil {
+	status["blocked"] = blocked
+	minTTL, maxTTL := p.ttlBounds()
+	status["minTtlSeconds"] = int(minTTL.Seconds())
+	status["maxTtlSeconds"] = int(maxTTL.Seconds())
+	if len(p.servers) == 0 {
 		status["running"] = false
 	} else {
 		status["running"] = p.started
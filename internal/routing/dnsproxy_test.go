@@ -0,0 +1,125 @@
+package routing
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func cname(name, target string) dns.RR {
+	return &dns.CNAME{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60}, Target: target}
+}
+
+func TestCNAMEChains(t *testing.T) {
+	tests := []struct {
+		name    string
+		answers []dns.RR
+		want    map[string][]string
+	}{
+		{
+			name: "no cnames",
+			want: map[string][]string{"www.example.com": {"www.example.com"}},
+		},
+		{
+			name:    "chain with mixed case and trailing dots",
+			answers: []dns.RR{cname("WWW.example.com.", "Edge.CDN.net."), cname("edge.cdn.net.", "a1.cdn.net.")},
+			want: map[string][]string{
+				"www.example.com": {"www.example.com"},
+				"edge.cdn.net":    {"www.example.com", "edge.cdn.net"},
+				"a1.cdn.net":      {"www.example.com", "edge.cdn.net", "a1.cdn.net"},
+			},
+		},
+		{
+			name:    "loop stops at the first repeated name",
+			answers: []dns.RR{cname("www.example.com.", "a.example.net."), cname("a.example.net.", "www.example.com.")},
+			want: map[string][]string{
+				"www.example.com": {"www.example.com"},
+				"a.example.net":   {"www.example.com", "a.example.net"},
+			},
+		},
+		{
+			name:    "cnames not reached from the question are ignored",
+			answers: []dns.RR{cname("www.example.com.", "a.example.net."), cname("other.example.org.", "b.example.net.")},
+			want: map[string][]string{
+				"www.example.com": {"www.example.com"},
+				"a.example.net":   {"www.example.com", "a.example.net"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := new(dns.Msg)
+			resp.SetQuestion("www.example.com.", dns.TypeA)
+			resp.Answer = tt.answers
+			if got := cnameChains(resp); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("cnameChains = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCNAMEChainsStopsAfterMaxHops(t *testing.T) {
+	resp := new(dns.Msg)
+	resp.SetQuestion("h0.example.com.", dns.TypeA)
+	for i := 0; i < maxCNAMEHops+4; i++ {
+		resp.Answer = append(resp.Answer, cname(fmt.Sprintf("h%d.example.com.", i), fmt.Sprintf("h%d.example.com.", i+1)))
+	}
+	chains := cnameChains(resp)
+	if len(chains) != maxCNAMEHops+1 {
+		t.Fatalf("followed %d names, want %d", len(chains), maxCNAMEHops+1)
+	}
+	if _, ok := chains[fmt.Sprintf("h%d.example.com", maxCNAMEHops+1)]; ok {
+		t.Error("chain followed past maxCNAMEHops")
+	}
+}
+
+func TestCNAMEChainsWithoutQuestion(t *testing.T) {
+	if chains := cnameChains(new(dns.Msg)); chains != nil {
+		t.Errorf("cnameChains = %v, want nil", chains)
+	}
+}
+
+func TestTrackAnswersAttributesAlongCNAMEChain(t *testing.T) {
+	proxy := &DNSProxy{}
+	policies := []PolicyStatus{
+		{PolicyGroup: PolicyGroup{Name: "example", Domains: []string{"example.com"}}},
+		{PolicyGroup: PolicyGroup{Name: "cdn", Domains: []string{"cdn.net"}}},
+		{PolicyGroup: PolicyGroup{Name: "other", Domains: []string{"*.other.org"}}},
+		{PolicyGroup: PolicyGroup{Name: "ads", Domains: []string{"ads.example.org"}, Action: ActionDeny}},
+	}
+	if err := proxy.UpdatePolicies(policies, nil); err != nil {
+		t.Fatal(err)
+	}
+	writer := newSetWriter(nil, 0)
+	proxy.writer = writer
+
+	a := func(name, ip string) dns.RR {
+		return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP(ip)}
+	}
+	resp := new(dns.Msg)
+	resp.SetQuestion("www.example.com.", dns.TypeA)
+	resp.Answer = []dns.RR{
+		cname("www.example.com.", "edge.cdn.net."),
+		a("edge.cdn.net.", "192.0.2.1"),
+		// Owners off the question's chain are attributed by their own name.
+		a("stray.other.org.", "192.0.2.2"),
+		a("unrelated.example.net.", "192.0.2.3"),
+		a("ads.example.org.", "192.0.2.4"),
+	}
+	proxy.trackAnswers(resp)
+
+	got := make(map[setKey]bool)
+	for key := range writer.pending {
+		got[key] = true
+	}
+	want := map[setKey]bool{
+		{policy: "example", ip: "192.0.2.1"}: true,
+		{policy: "other", ip: "192.0.2.2"}:   true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("queued elements = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,93 @@
+package routing
+
+import "strings"
+
+// domainTrie maps policy domains to policy names, keyed label by label from
+// the TLD down so a lookup costs one step per label of the queried name
+// however many domains the policies list.
+//
+// A plain entry such as "example.com" matches the name itself and every
+// name below it; "*.example.com" matches only names below it. When several
+// entries match, the deepest one wins, and at equal depth a wildcard beats a
+// plain entry for the names below it.
+type domainTrie struct {
+	root *trieNode
+	size int
+}
+
+type trieNode struct {
+	children map[string]*trieNode
+	suffix   string // policy for this name and everything below it
+	wildcard string // policy for names strictly below this one
+}
+
+func newDomainTrie() *domainTrie {
+	return &domainTrie{root: &trieNode{}}
+}
+
+// Insert adds a policy domain. Later inserts of the same domain replace
+// earlier ones.
+func (t *domainTrie) Insert(domain, policy string) {
+	domain = normalizeDomain(domain)
+	wildcard := false
+	switch {
+	case strings.HasPrefix(domain, "*."):
+		wildcard, domain = true, domain[2:]
+	case strings.HasPrefix(domain, "."):
+		domain = domain[1:]
+	}
+	if domain == "" {
+		return
+	}
+	node := t.root
+	labels := strings.Split(domain, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[string]*trieNode)
+			}
+			child = &trieNode{}
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	entry := &node.suffix
+	if wildcard {
+		entry = &node.wildcard
+	}
+	if *entry == "" {
+		t.size++
+	}
+	*entry = policy
+}
+
+// Lookup returns the policy of the most specific entry matching name.
+func (t *domainTrie) Lookup(name string) (string, bool) {
+	name = normalizeDomain(name)
+	if name == "" {
+		return "", false
+	}
+	labels := strings.Split(name, ".")
+	node := t.root
+	match := ""
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			break
+		}
+		node = child
+		if node.suffix != "" {
+			match = node.suffix
+		}
+		if i > 0 && node.wildcard != "" {
+			match = node.wildcard
+		}
+	}
+	return match, match != ""
+}
+
+// Len reports the number of entries.
+func (t *domainTrie) Len() int {
+	return t.size
+}
@@ -0,0 +1,53 @@
+package routing
+
+import "testing"
+
+func TestDomainTrieLookup(t *testing.T) {
+	trie := newDomainTrie()
+	trie.Insert("Example.COM.", "plain")
+	trie.Insert("*.wild.org", "wild")
+	trie.Insert("cdn.example.com", "cdn")
+	trie.Insert("*.cdn.example.com", "cdn-below")
+	trie.Insert(".dot.net", "dot")
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"example.com", "plain"},
+		{"WWW.Example.com.", "plain"},
+		{"notexample.com", ""},
+		{"com", ""},
+		{"wild.org", ""},
+		{"a.wild.org", "wild"},
+		{"a.b.wild.org.", "wild"},
+		{"cdn.example.com", "cdn"},
+		{"x.cdn.example.com", "cdn-below"},
+		{"a.b.CDN.example.com", "cdn-below"},
+		{"dot.net", "dot"},
+		{"a.dot.net", "dot"},
+		{"", ""},
+		{".", ""},
+	}
+	for _, tt := range tests {
+		got, ok := trie.Lookup(tt.name)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("Lookup(%q) = %q, %v; want %q", tt.name, got, ok, tt.want)
+		}
+	}
+	if trie.Len() != 5 {
+		t.Errorf("Len = %d, want 5", trie.Len())
+	}
+}
+
+func TestDomainTrieInsertReplaces(t *testing.T) {
+	trie := newDomainTrie()
+	trie.Insert("example.com", "first")
+	trie.Insert("EXAMPLE.com.", "second")
+	if got, _ := trie.Lookup("www.example.com"); got != "second" {
+		t.Errorf("Lookup after re-insert = %q, want second", got)
+	}
+	if trie.Len() != 1 {
+		t.Errorf("Len = %d, want 1", trie.Len())
+	}
+}
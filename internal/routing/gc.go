@@ -0,0 +1,56 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// collectGarbage tears down what prev owned and next no longer wants: static
+// routes no longer requested, the WireGuard interfaces of removed nodes,
+// peers replaced by a new public key, fwmark rules no longer wanted and route
+// tables no longer in use. Stale dns_* sets are dropped by NFTManager.Ensure.
+func collectGarbage(ctx context.Context, prev, next RoutingState) error {
+	removeStaleRoutes(ctx, prev.Routes, next.Routes)
+	var errs []error
+	nextNodes := make(map[string]NodeStatus, len(next.Nodes))
+	nextTables := make(map[int]bool, len(next.Nodes))
+	nextRules := make(map[[2]int]bool, len(next.Nodes))
+	for _, node := range next.Nodes {
+		nextNodes[node.Interface] = node
+		nextTables[node.TableID] = true
+		nextRules[[2]int{node.Mark, node.TableID}] = true
+	}
+	for _, node := range prev.Nodes {
+		kept, ok := nextNodes[node.Interface]
+		switch {
+		case !ok:
+			if err := removeInterface(ctx, node.Interface); err != nil {
+				errs = append(errs, err)
+			}
+		case kept.PublicKey != node.PublicKey && node.PublicKey != "":
+			// The old peer may never have been added if prev was itself
+			// only partially applied.
+			_ = run(ctx, "wg", "set", node.Interface, "peer", node.PublicKey, "remove")
+		}
+		for _, family := range ipFamilies() {
+			if !nextRules[[2]int{node.Mark, node.TableID}] {
+				_ = run(ctx, "ip", family, "rule", "del", "fwmark", fmt.Sprint(node.Mark), "lookup", fmt.Sprint(node.TableID))
+			}
+			if !nextTables[node.TableID] {
+				_ = run(ctx, "ip", family, "route", "flush", "table", fmt.Sprint(node.TableID))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func removeInterface(ctx context.Context, iface string) error {
+	if err := run(ctx, "ip", "link", "show", iface); err != nil {
+		return nil
+	}
+	if err := run(ctx, "ip", "link", "del", "dev", iface); err != nil {
+		return fmt.Errorf("remove interface %s: %w", iface, err)
+	}
+	return nil
+}
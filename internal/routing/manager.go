@@ -2,7 +2,12 @@ package routing
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sync"
 	"time"
 )
 
@@ -10,86 +15,318 @@ type Manager struct {
 	WireGuard *WireGuardManager
 	NFT       *NFTManager
 	DNS       *DNSProxy
+	// Allocator keeps node table IDs and marks stable across applies.
+	// Without one they follow the order of the request's nodes.
+	Allocator *Allocator
+
+	// mu serializes changes to the applied state. ApplyStored, Repair and
+	// Plan hold it from loading the saved state until they are done with
+	// it, so an /apply, a /plan and a reconciler repair never interleave.
+	mu sync.Mutex
 }
 
-func (m *Manager) Apply(ctx context.Context, req ApplyRequest) (RoutingState, error) {
-	if m.WireGuard == nil {
-		m.WireGuard = &WireGuardManager{}
-	}
-	if m.NFT == nil {
-		m.NFT = &NFTManager{}
+// Apply steps, as reported in ApplyError.Step.
+const (
+	StepWireGuard = "wireguard"
+	StepIPRules   = "ip-rules"
+	StepRoutes    = "routes"
+	StepNFT       = "nftables"
+	StepDNS       = "dns"
+	StepCleanup   = "cleanup"
+)
+
+// ApplyError reports the step an Apply failed at and whether the kernel was
+// rolled back to the previous state afterwards.
+type ApplyError struct {
+	Step        string
+	Err         error
+	RolledBack  bool
+	RollbackErr error
+}
+
+func (e *ApplyError) Error() string {
+	if e.RolledBack {
+		return fmt.Sprintf("%s: %v (rolled back)", e.Step, e.Err)
 	}
-	if m.DNS == nil {
-		m.DNS = &DNSProxy{NFT: m.NFT}
-	} else if m.DNS.NFT == nil {
-		m.DNS.NFT = m.NFT
+	return fmt.Sprintf("%s: %v (rollback failed: %v)", e.Step, e.Err, e.RollbackErr)
+}
+
+func (e *ApplyError) Unwrap() error {
+	return e.Err
+}
+
+// StateStoreError reports that ApplyStored, Plan or Repair could not load or
+// save the routing state, as opposed to the request being rejected.
+type StateStoreError struct {
+	Err error
+}
+
+func (e *StateStoreError) Error() string {
+	return fmt.Sprintf("routing state: %v", e.Err)
+}
+
+func (e *StateStoreError) Unwrap() error {
+	return e.Err
+}
+
+// applyStep programs one part of next into the kernel. prev is the state
+// being replaced, for steps that need to know what to remove. Steps may
+// record per-object outcomes in next.
+type applyStep struct {
+	name string
+	run  func(ctx context.Context, m *Manager, prev RoutingState, next *RoutingState) error
+}
+
+var applySteps = []applyStep{
+	{StepWireGuard, func(ctx context.Context, m *Manager, _ RoutingState, next *RoutingState) error {
+		return m.WireGuard.Ensure(ctx, next.Nodes)
+	}},
+	{StepIPRules, func(ctx context.Context, _ *Manager, _ RoutingState, next *RoutingState) error {
+		return ensureIPRules(ctx, next.Nodes)
+	}},
+	{StepRoutes, func(ctx context.Context, _ *Manager, _ RoutingState, next *RoutingState) error {
+		ensureRoutes(ctx, next.Nodes, next.Routes)
+		return nil
+	}},
+	{StepNFT, func(ctx context.Context, m *Manager, _ RoutingState, next *RoutingState) error {
+		return m.NFT.Ensure(ctx, next.Policies)
+	}},
+	{StepDNS, func(_ context.Context, m *Manager, _ RoutingState, next *RoutingState) error {
+		if err := m.DNS.Start(); err != nil {
+			return err
+		}
+		return m.DNS.UpdatePolicies(next.Policies, next.Nodes)
+	}},
+	{StepCleanup, func(ctx context.Context, _ *Manager, prev RoutingState, next *RoutingState) error {
+		return collectGarbage(ctx, prev, *next)
+	}},
+}
+
+// Apply programs req into the kernel. prev is the state currently applied;
+// if any step fails, Apply restores prev and returns an *ApplyError.
+func (m *Manager) Apply(ctx context.Context, prev RoutingState, req ApplyRequest) (RoutingState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.apply(ctx, prev, req)
+}
+
+// ApplyStored applies req over the state saved in store and saves the
+// result, as one step with respect to other applies and repairs.
+func (m *Manager) ApplyStored(ctx context.Context, store *StateStore, req ApplyRequest) (RoutingState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prev, _, err := store.Load(ctx)
+	if err != nil {
+		return RoutingState{}, &StateStoreError{Err: err}
 	}
-	nodeStatuses, policyStatuses, err := m.buildStatus(req)
+	state, err := m.apply(ctx, prev, req)
 	if err != nil {
 		return RoutingState{}, err
 	}
-	if err := m.WireGuard.Ensure(ctx, nodeStatuses); err != nil {
-		return RoutingState{}, err
+	if err := store.Save(ctx, state); err != nil {
+		return RoutingState{}, &StateStoreError{Err: err}
 	}
-	if err := ensureIPRules(ctx, nodeStatuses); err != nil {
-		return RoutingState{}, err
+	return state, nil
+}
+
+// Repair re-applies the state saved in store, provided it is still the one
+// applied at appliedAt, and saves the result so route install outcomes stay
+// current. It reports false without touching the kernel when another apply
+// has replaced it since.
+func (m *Manager) Repair(ctx context.Context, store *StateStore, appliedAt time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state, ok, err := store.Load(ctx)
+	if err != nil {
+		return false, err
+	}
+	if !ok || !state.AppliedAt.Equal(appliedAt) {
+		return false, nil
+	}
+	repaired, err := m.apply(ctx, state, state.Request())
+	if err != nil {
+		return false, err
+	}
+	if err := store.Save(ctx, repaired); err != nil {
+		return false, &StateStoreError{Err: err}
 	}
-	if err := m.NFT.Ensure(ctx, policyStatuses); err != nil {
+	return true, nil
+}
+
+func (m *Manager) apply(ctx context.Context, prev RoutingState, req ApplyRequest) (RoutingState, error) {
+	m.defaults()
+	allocated, err := m.allocatedNodes(ctx)
+	if err != nil {
 		return RoutingState{}, err
 	}
-	if err := m.DNS.Start(); err != nil {
+	state, err := m.buildState(ctx, req, true)
+	if err != nil {
+		m.releaseAllocations(context.WithoutCancel(ctx), allocated)
 		return RoutingState{}, err
 	}
-	m.DNS.UpdatePolicies(policyStatuses)
-	state := RoutingState{
-		AppliedAt: time.Now().UTC(),
-		Nodes:     nodeStatuses,
-		Policies:  policyStatuses,
-		Routes:    req.Routes,
+	for _, step := range applySteps {
+		if err := step.run(ctx, m, prev, &state); err != nil {
+			applyErr := &ApplyError{Step: step.name, Err: err}
+			applyErr.RollbackErr = m.rollback(context.WithoutCancel(ctx), prev, state)
+			applyErr.RolledBack = applyErr.RollbackErr == nil
+			m.releaseAllocations(context.WithoutCancel(ctx), allocated)
+			return RoutingState{}, applyErr
+		}
+	}
+	names := make([]string, 0, len(state.Nodes))
+	for _, node := range state.Nodes {
+		names = append(names, node.Name)
 	}
+	m.releaseAllocations(ctx, names)
+	state.AppliedAt = time.Now().UTC()
 	return state, nil
 }
 
-func (m *Manager) buildStatus(req ApplyRequest) ([]NodeStatus, []PolicyStatus, error) {
+// allocatedNodes returns the nodes that hold a table allocation, so a
+// failed Apply can give back the ones it added.
+func (m *Manager) allocatedNodes(ctx context.Context) ([]string, error) {
+	if m.Allocator == nil {
+		return nil, nil
+	}
+	allocs, err := m.Allocator.Allocations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(allocs))
+	for _, alloc := range allocs {
+		names = append(names, alloc.Node)
+	}
+	return names, nil
+}
+
+// releaseAllocations frees the table allocations of every node not in keep.
+func (m *Manager) releaseAllocations(ctx context.Context, keep []string) {
+	if m.Allocator == nil {
+		return
+	}
+	if err := m.Allocator.Release(ctx, keep); err != nil {
+		log.Printf("release table allocations: %v", err)
+	}
+}
+
+func (m *Manager) defaults() {
+	if m.WireGuard == nil {
+		m.WireGuard = &WireGuardManager{}
+	}
+	if m.NFT == nil {
+		m.NFT = &NFTManager{}
+	}
+	if m.DNS == nil {
+		m.DNS = &DNSProxy{NFT: m.NFT}
+	} else if m.DNS.NFT == nil {
+		m.DNS.NFT = m.NFT
+	}
+}
+
+// rollback reprograms prev after a partial apply of failed; the cleanup step
+// removes whatever failed had already added.
+func (m *Manager) rollback(ctx context.Context, prev, failed RoutingState) error {
+	var errs []error
+	restored := prev
+	restored.Routes = slices.Clone(prev.Routes)
+	for _, step := range applySteps {
+		if err := step.run(ctx, m, failed, &restored); err != nil {
+			errs = append(errs, fmt.Errorf("restore %s: %w", step.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// buildState resolves req into node, policy and route statuses. commit
+// controls whether table allocations for new nodes are persisted.
+func (m *Manager) buildState(ctx context.Context, req ApplyRequest, commit bool) (RoutingState, error) {
+	allocs, err := m.allocate(ctx, req.Nodes, commit)
+	if err != nil {
+		return RoutingState{}, err
+	}
 	nodeStatuses := make([]NodeStatus, 0, len(req.Nodes))
-	nodeTable := make(map[string]int, len(req.Nodes))
+	nodeAllocs := make(map[string]TableAllocation, len(req.Nodes))
 	for i, node := range req.Nodes {
-		tableID := 101 + i
-		nodeTable[node.Name] = tableID
+		alloc := allocs[i]
+		nodeAllocs[node.Name] = alloc
 		nodeStatuses = append(nodeStatuses, NodeStatus{
 			EgressNode: node,
 			Interface:  fmt.Sprintf("wg-egress-%s", sanitizeName(node.Name)),
-			TableID:    tableID,
+			TableID:    alloc.TableID,
+			Mark:       alloc.Mark,
 		})
 	}
 	policyStatuses := make([]PolicyStatus, 0, len(req.Policies))
 	for _, policy := range req.Policies {
-		tableID, ok := nodeTable[policy.Node]
+		alloc, ok := nodeAllocs[policy.Node]
 		if !ok && policy.Node != "" {
-			return nil, nil, fmt.Errorf("unknown node %s for policy %s", policy.Node, policy.Name)
+			return RoutingState{}, fmt.Errorf("unknown node %s for policy %s", policy.Node, policy.Name)
 		}
 		if policy.Node == "" && len(nodeStatuses) > 0 {
-			tableID = nodeStatuses[0].TableID
+			alloc = allocs[0]
+		}
+		if err := validateResolver(policy); err != nil {
+			return RoutingState{}, err
+		}
+		if policy.Resolver != "" && len(nodeStatuses) == 0 {
+			return RoutingState{}, fmt.Errorf("policy %s: resolver %q needs an egress node", policy.Name, policy.Resolver)
 		}
-		mark := tableID
 		policyStatuses = append(policyStatuses, PolicyStatus{
 			PolicyGroup: policy,
-			Mark:        mark,
-			Table:       tableID,
+			Mark:        alloc.Mark,
+			Table:       alloc.TableID,
 			Active:      true,
 		})
 	}
-	return nodeStatuses, policyStatuses, nil
+	routeStatuses, err := buildRoutes(req.Routes, nodeAllocs)
+	if err != nil {
+		return RoutingState{}, err
+	}
+	return RoutingState{Nodes: nodeStatuses, Policies: policyStatuses, Routes: routeStatuses}, nil
+}
+
+// allocate returns the table allocation for each of nodes, in order.
+func (m *Manager) allocate(ctx context.Context, nodes []EgressNode, commit bool) ([]TableAllocation, error) {
+	allocs := make([]TableAllocation, len(nodes))
+	if m.Allocator == nil {
+		for i, node := range nodes {
+			allocs[i] = TableAllocation{Node: node.Name, TableID: 101 + i, Mark: 101 + i}
+		}
+		return allocs, nil
+	}
+	names := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		names = append(names, node.Name)
+	}
+	byName, err := m.Allocator.Allocate(ctx, names, commit)
+	if err != nil {
+		return nil, err
+	}
+	for i, node := range nodes {
+		allocs[i] = byName[node.Name]
+	}
+	return allocs, nil
 }
 
 func ensureIPRules(ctx context.Context, nodes []NodeStatus) error {
 	for _, node := range nodes {
-		if err := run(ctx, "ip", "rule", "del", "fwmark", fmt.Sprint(node.TableID), "lookup", fmt.Sprint(node.TableID)); err != nil {
-			// ignore delete errors
-		}
-		if err := run(ctx, "ip", "rule", "add", "fwmark", fmt.Sprint(node.TableID), "lookup", fmt.Sprint(node.TableID)); err != nil {
-			return fmt.Errorf("ip rule for table %d: %w", node.TableID, err)
+		for _, family := range ipFamilies() {
+			if err := run(ctx, "ip", family, "rule", "del", "fwmark", fmt.Sprint(node.Mark), "lookup", fmt.Sprint(node.TableID)); err != nil {
+				// ignore delete errors
+			}
+			if err := run(ctx, "ip", family, "rule", "add", "fwmark", fmt.Sprint(node.Mark), "lookup", fmt.Sprint(node.TableID)); err != nil {
+				return fmt.Errorf("ip %s rule for table %d: %w", family, node.TableID, err)
+			}
 		}
 	}
 	return nil
 }
+
+// ipFamilies returns the `ip` family flags rules and egress routes are
+// installed for: IPv4 always, IPv6 unless the kernel has it disabled.
+func ipFamilies() []string {
+	if _, err := os.Stat("/proc/net/if_inet6"); err != nil {
+		return []string{"-4"}
+	}
+	return []string{"-4", "-6"}
+}
@@ -0,0 +1,40 @@
+package routing
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestFailedApplyReleasesNewAllocations(t *testing.T) {
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("allocating tables inspects the host with ip")
+	}
+	ctx := context.Background()
+	store, err := OpenStateStore(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	allocator := &Allocator{Store: store}
+	if _, err := allocator.Allocate(ctx, []string{"de"}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	manager := &Manager{Allocator: allocator}
+	req := ApplyRequest{
+		Nodes:    []EgressNode{{Name: "de"}, {Name: "uk"}},
+		Policies: []PolicyGroup{{Name: "bbc", Node: "missing"}},
+	}
+	if _, err := manager.Apply(ctx, RoutingState{}, req); err == nil {
+		t.Fatal("apply with a policy on an unknown node succeeded")
+	}
+	allocs, err := allocator.Allocations(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocs) != 1 || allocs[0].Node != "de" {
+		t.Fatalf("allocations after failed apply = %+v, want only de", allocs)
+	}
+}
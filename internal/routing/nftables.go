@@ -2,8 +2,12 @@ package routing
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
+	"sort"
 	"strings"
+	"time"
 )
 
 type NFTManager struct {
@@ -11,114 +15,320 @@ type NFTManager struct {
 	Family string
 }
 
+// Ensure loads the complete octaroute table for policies in a single
+// `nft -f` transaction, so either the whole ruleset lands or none of it does.
+// Existing DNS sets are declared rather than recreated, which keeps the
+// addresses the DNS proxy has already learned; dns_* sets no policy uses any
+// more are deleted, as are sets created before elements carried a timeout,
+// which are then recreated empty.
 func (m *NFTManager) Ensure(ctx context.Context, policies []PolicyStatus) error {
+	m.defaults()
+	stale := m.staleDNSSets(ctx, policies)
+	if err := runInput(ctx, m.Render(policies, stale), "nft", "-f", "-"); err != nil {
+		return fmt.Errorf("load nft ruleset: %w", err)
+	}
+	return nil
+}
+
+func (m *NFTManager) defaults() {
 	if m.Table == "" {
 		m.Table = "octaroute"
 	}
 	if m.Family == "" {
 		m.Family = "inet"
 	}
-	if err := m.ensureTable(ctx); err != nil {
-		return err
+}
+
+// staleDNSSets lists the dns_* sets in the live table that policies no
+// longer populate. A missing table has none.
+func (m *NFTManager) staleDNSSets(ctx context.Context, policies []PolicyStatus) []string {
+	live, err := m.liveDNSSets(ctx)
+	if err != nil {
+		return nil
 	}
-	if err := m.ensureChain(ctx); err != nil {
-		return err
+	wanted := make(map[string]bool)
+	for _, name := range domainSets(policies) {
+		wanted[name] = true
+	}
+	var stale []string
+	for name, timeout := range live {
+		if !wanted[name] || !timeout {
+			stale = append(stale, name)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+// liveDNSSets maps the dns sets in the live table to whether they have the
+// timeout flag.
+func (m *NFTManager) liveDNSSets(ctx context.Context) (map[string]bool, error) {
+	listing, err := output(ctx, "nft", "list", "sets", "table", m.Family, m.Table)
+	if err != nil {
+		return nil, err
+	}
+	return parseDNSSets(listing), nil
+}
+
+// parseDNSSets maps the dns sets in an `nft list sets` listing to whether
+// they have the timeout flag.
+func parseDNSSets(listing string) map[string]bool {
+	sets := make(map[string]bool)
+	current := ""
+	for _, line := range strings.Split(listing, "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) >= 2 && fields[0] == "set":
+			current = ""
+			if isDNSSet(fields[1]) {
+				current = fields[1]
+				sets[current] = false
+			}
+		case len(fields) >= 2 && fields[0] == "flags" && current != "":
+			sets[current] = strings.Contains(line, "timeout")
+		}
 	}
-	if err := run(ctx, "nft", "flush", "chain", m.Family, m.Table, "prerouting"); err != nil {
-		return fmt.Errorf("flush nft chain: %w", err)
+	return sets
+}
+
+// Render returns the nft script Ensure loads for policies, deleting the
+// stale sets once the chain no longer references them.
+func (m *NFTManager) Render(policies []PolicyStatus, stale []string) string {
+	m.defaults()
+	var b strings.Builder
+	fmt.Fprintf(&b, "add table %s %s\n", m.Family, m.Table)
+	fmt.Fprintf(&b, "add chain %s %s prerouting { type filter hook prerouting priority mangle ; policy accept ; }\n", m.Family, m.Table)
+	fmt.Fprintf(&b, "flush chain %s %s prerouting\n", m.Family, m.Table)
+	for _, name := range stale {
+		fmt.Fprintf(&b, "delete set %s %s %s\n", m.Family, m.Table, name)
 	}
 	for _, policy := range policies {
-		if err := m.ensureDNSSet(ctx, policy.Name); err != nil {
-			return err
+		if !learnsDomains(policy.PolicyGroup) {
+			continue
+		}
+		for _, family := range families {
+			fmt.Fprintf(&b, "add set %s %s %s { type %s ; flags timeout ; }\n", m.Family, m.Table, family.setName(policy.Name), family.setType)
 		}
 	}
 	for _, policy := range policies {
-		if err := m.addPolicyRules(ctx, policy); err != nil {
-			return err
+		for _, rule := range policyRules(policy) {
+			fmt.Fprintf(&b, "add rule %s %s prerouting %s\n", m.Family, m.Table, rule)
 		}
 	}
-	return nil
+	return b.String()
 }
 
-func (m *NFTManager) ensureTable(ctx context.Context) error {
-	if err := run(ctx, "nft", "list", "table", m.Family, m.Table); err == nil {
-		return nil
-	}
-	if err := run(ctx, "nft", "add", "table", m.Family, m.Table); err != nil {
-		return fmt.Errorf("add nft table: %w", err)
+// addressFamily is one side of a dual-stack policy.
+type addressFamily struct {
+	match     string // nft payload protocol: ip or ip6
+	setType   string
+	setPrefix string
+	ipv6      bool
+}
+
+var families = []addressFamily{
+	{match: "ip", setType: "ipv4_addr", setPrefix: "dns_"},
+	{match: "ip6", setType: "ipv6_addr", setPrefix: "dns6_", ipv6: true},
+}
+
+func (f addressFamily) setName(policyName string) string {
+	return f.setPrefix + sanitizeName(policyName)
+}
+
+// filter returns the addresses or CIDRs of values that belong to f.
+func (f addressFamily) filter(values []string) []string {
+	var matched []string
+	for _, value := range values {
+		if isIPv6(value) == f.ipv6 {
+			matched = append(matched, value)
+		}
 	}
-	return nil
+	return matched
 }
 
-func (m *NFTManager) ensureChain(ctx context.Context) error {
-	if err := run(ctx, "nft", "list", "chain", m.Family, m.Table, "prerouting"); err == nil {
+// policyRules renders the prerouting rules that mark policy's traffic. Each
+// address family gets its own rules; a family is skipped when the policy
+// restricts sources or destinations to the other one.
+func policyRules(policy PolicyStatus) []string {
+	if !routes(policy.PolicyGroup) {
 		return nil
 	}
-	rule := fmt.Sprintf("add chain %s %s prerouting { type filter hook prerouting priority mangle ; policy accept ; }", m.Family, m.Table)
-	if err := run(ctx, "nft", ruleParts(rule)...); err != nil {
-		return fmt.Errorf("add nft chain: %w", err)
+	mark := fmt.Sprintf("meta mark set %d", policy.Mark)
+	if len(policy.SourceCIDRs) == 0 && len(policy.DestinationCIDRs) == 0 && len(policy.Domains) == 0 {
+		return []string{mark}
 	}
-	return nil
+	var rules []string
+	for _, family := range families {
+		sources := family.filter(policy.SourceCIDRs)
+		if len(policy.SourceCIDRs) > 0 && len(sources) == 0 {
+			continue
+		}
+		var source []string
+		if len(sources) > 0 {
+			source = []string{family.match + " saddr " + nftSet(sources)}
+		}
+		destinations := family.filter(policy.DestinationCIDRs)
+		if len(destinations) > 0 || (len(sources) > 0 && len(policy.DestinationCIDRs) == 0) {
+			match := append([]string{}, source...)
+			if len(destinations) > 0 {
+				match = append(match, family.match+" daddr "+nftSet(destinations))
+			}
+			rules = append(rules, strings.Join(append(match, mark), " "))
+		}
+		if len(policy.Domains) > 0 {
+			dns := append(append([]string{}, source...), family.match+" daddr @"+family.setName(policy.Name), mark)
+			rules = append(rules, strings.Join(dns, " "))
+		}
+	}
+	return rules
 }
 
-func (m *NFTManager) ensureDNSSet(ctx context.Context, name string) error {
-	setName := dnsSetName(name)
-	if err := run(ctx, "nft", "list", "set", m.Family, m.Table, setName); err == nil {
-		return nil
+// routes reports whether policy's traffic is marked for its egress node.
+func routes(policy PolicyGroup) bool {
+	return policy.Action == "" || policy.Action == ActionAllow
+}
+
+// learnsDomains reports whether the DNS proxy fills policy's dns sets.
+func learnsDomains(policy PolicyGroup) bool {
+	return len(policy.Domains) > 0 && routes(policy)
+}
+
+func nftSet(values []string) string {
+	return "{ " + strings.Join(values, ", ") + " }"
+}
+
+// SetElement is an address to add to a policy's DNS set.
+type SetElement struct {
+	IP      string
+	Timeout time.Duration
+}
+
+// AddDomainIPs adds resolved addresses to the policy's set for their
+// family, expiring after timeout.
+func (m *NFTManager) AddDomainIPs(ctx context.Context, policyName string, ips []string, timeout time.Duration) error {
+	elements := make([]SetElement, 0, len(ips))
+	for _, ip := range ips {
+		elements = append(elements, SetElement{IP: ip, Timeout: timeout})
+	}
+	missing, err := m.AddDomainElements(ctx, map[string][]SetElement{policyName: elements})
+	if err != nil {
+		return err
 	}
-	rule := fmt.Sprintf("add set %s %s %s { type ipv4_addr ; flags interval ; }", m.Family, m.Table, setName)
-	if err := run(ctx, "nft", ruleParts(rule)...); err != nil {
-		return fmt.Errorf("add nft set: %w", err)
+	if len(missing) > 0 {
+		return fmt.Errorf("add nft element: set %s: %w", strings.Join(missing, ", "), ErrSetMissing)
 	}
 	return nil
 }
 
-func (m *NFTManager) addPolicyRules(ctx context.Context, policy PolicyStatus) error {
-	if policy.Action != "" && policy.Action != "allow" {
-		return nil
+// ErrSetMissing reports that a policy's DNS set is not in the live table,
+// as when an apply dropped the policy after its answer was resolved.
+var ErrSetMissing = errors.New("nft set missing")
+
+// AddDomainElements adds elements, keyed by policy name, to the policies'
+// sets in a single nft transaction. Elements for sets missing from the live
+// table are dropped and their set names returned, so one stale policy does
+// not fail the whole batch. Addresses already in a set get their timeout
+// restarted: each is added, deleted and re-added, since adding an existing
+// element leaves its old expiry in place.
+func (m *NFTManager) AddDomainElements(ctx context.Context, elements map[string][]SetElement) ([]string, error) {
+	m.defaults()
+	live, err := m.liveDNSSets(ctx)
+	if err != nil {
+		// Without the table every set is missing.
+		live = nil
 	}
-	base := []string{"add", "rule", m.Family, m.Table, "prerouting"}
-	match := []string{}
-	if len(policy.SourceCIDRs) > 0 {
-		match = append(match, "ip", "saddr", "{", strings.Join(policy.SourceCIDRs, ","), "}")
+	script, missing := m.renderElements(elements, live)
+	if len(missing) > 0 {
+		log.Printf("dns: dropping learned addresses for missing nft sets %s", strings.Join(missing, ", "))
 	}
-	if len(policy.DestinationCIDRs) > 0 {
-		match = append(match, "ip", "daddr", "{", strings.Join(policy.DestinationCIDRs, ","), "}")
+	if script == "" {
+		return missing, nil
 	}
-	mark := []string{"meta", "mark", "set", fmt.Sprint(policy.Mark)}
-	if len(match) > 0 || (len(policy.SourceCIDRs) == 0 && len(policy.DestinationCIDRs) == 0 && len(policy.Domains) == 0) {
-		args := append(base, match...)
-		args = append(args, mark...)
-		if err := run(ctx, "nft", args...); err != nil {
-			return fmt.Errorf("add nft rule: %w", err)
-		}
+	if err := runInput(ctx, script, "nft", "-f", "-"); err != nil {
+		return missing, fmt.Errorf("add nft element: %w", err)
 	}
-	if len(policy.Domains) > 0 {
-		args := append(base, "ip", "daddr", "@"+dnsSetName(policy.Name))
-		if len(policy.SourceCIDRs) > 0 {
-			args = append(base, "ip", "saddr", "{", strings.Join(policy.SourceCIDRs, ","), "}", "ip", "daddr", "@"+dnsSetName(policy.Name))
+	return missing, nil
+}
+
+// renderElements returns the nft script adding elements to the sets in
+// live, and the sorted names of the sets elements needed that live lacks.
+func (m *NFTManager) renderElements(elements map[string][]SetElement, live map[string]bool) (string, []string) {
+	policies := make([]string, 0, len(elements))
+	for policy := range elements {
+		policies = append(policies, policy)
+	}
+	sort.Strings(policies)
+	var b strings.Builder
+	var missing []string
+	for _, policy := range policies {
+		for _, family := range families {
+			var ips, timed, refresh []string
+			for _, element := range elements[policy] {
+				if isIPv6(element.IP) != family.ipv6 {
+					continue
+				}
+				ips = append(ips, element.IP)
+				timed = append(timed, element.IP+nftTimeout(element.Timeout))
+				if element.Timeout > 0 {
+					refresh = append(refresh, element.IP+nftTimeout(element.Timeout))
+				}
+			}
+			if len(ips) == 0 {
+				continue
+			}
+			set := family.setName(policy)
+			if _, ok := live[set]; !ok {
+				missing = append(missing, set)
+				continue
+			}
+			fmt.Fprintf(&b, "add element %s %s %s { %s }\n", m.Family, m.Table, set, strings.Join(timed, ", "))
+			if len(refresh) > 0 {
+				fmt.Fprintf(&b, "delete element %s %s %s { %s }\n", m.Family, m.Table, set, strings.Join(ips, ", "))
+				fmt.Fprintf(&b, "add element %s %s %s { %s }\n", m.Family, m.Table, set, strings.Join(timed, ", "))
+			}
 		}
-		args = append(args, mark...)
-		if err := run(ctx, "nft", args...); err != nil {
-			return fmt.Errorf("add nft dns rule: %w", err)
+	}
+	return b.String(), missing
+}
+
+// dnsSetName returns the set of policy that holds ip.
+func dnsSetName(policyName, ip string) string {
+	for _, family := range families {
+		if isIPv6(ip) == family.ipv6 {
+			return family.setName(policyName)
 		}
 	}
-	return nil
+	return ""
 }
 
-func (m *NFTManager) AddDomainIPs(ctx context.Context, policyName string, ips []string) error {
-	if len(ips) == 0 {
-		return nil
+func nftTimeout(timeout time.Duration) string {
+	if timeout <= 0 {
+		return ""
 	}
-	args := []string{"add", "element", m.Family, m.Table, dnsSetName(policyName), "{" + strings.Join(ips, ",") + "}"}
-	if err := run(ctx, "nft", args...); err != nil {
-		return fmt.Errorf("add nft element: %w", err)
+	return fmt.Sprintf(" timeout %ds", int(timeout.Seconds()))
+}
+
+// dnsSetNames returns the IPv4 and IPv6 set names for a policy.
+func dnsSetNames(policyName string) []string {
+	names := make([]string, 0, len(families))
+	for _, family := range families {
+		names = append(names, family.setName(policyName))
 	}
-	return nil
+	return names
+}
+
+func isDNSSet(name string) bool {
+	for _, family := range families {
+		if strings.HasPrefix(name, family.setPrefix) {
+			return true
+		}
+	}
+	return false
 }
 
-func dnsSetName(policyName string) string {
-	return "dns_" + sanitizeName(policyName)
+// isIPv6 reports whether an address or CIDR is IPv6.
+func isIPv6(value string) bool {
+	return strings.Contains(value, ":")
 }
 
 func sanitizeName(value string) string {
@@ -139,7 +349,3 @@ func sanitizeName(value string) string {
 	}, value)
 	return value
 }
-
-func ruleParts(rule string) []string {
-	return strings.Fields(rule)
-}
@@ -0,0 +1,140 @@
+package routing
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRender(t *testing.T) {
+	nft := &NFTManager{}
+	policies := []PolicyStatus{
+		{PolicyGroup: PolicyGroup{Name: "office-uk", SourceCIDRs: []string{"10.0.0.0/24"}, DestinationCIDRs: []string{"203.0.113.0/24"}}, Mark: 101},
+		{PolicyGroup: PolicyGroup{Name: "bbc", Domains: []string{"bbc.co.uk"}, Action: ActionAllow}, Mark: 102},
+		{PolicyGroup: PolicyGroup{Name: "ads", Domains: []string{"ads.example"}, Action: ActionDeny}, Mark: 101},
+	}
+	want := `add table inet octaroute
+add chain inet octaroute prerouting { type filter hook prerouting priority mangle ; policy accept ; }
+flush chain inet octaroute prerouting
+delete set inet octaroute dns6_old
+delete set inet octaroute dns_old
+add set inet octaroute dns_bbc { type ipv4_addr ; flags timeout ; }
+add set inet octaroute dns6_bbc { type ipv6_addr ; flags timeout ; }
+add rule inet octaroute prerouting ip saddr { 10.0.0.0/24 } ip daddr { 203.0.113.0/24 } meta mark set 101
+add rule inet octaroute prerouting ip daddr @dns_bbc meta mark set 102
+add rule inet octaroute prerouting ip6 daddr @dns6_bbc meta mark set 102
+`
+	if got := nft.Render(policies, []string{"dns6_old", "dns_old"}); got != want {
+		t.Errorf("Render =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestParseDNSSets(t *testing.T) {
+	listing := `table inet octaroute {
+	set dns_bbc {
+		type ipv4_addr
+		size 65535
+		flags timeout
+	}
+	set dns6_bbc {
+		type ipv6_addr
+	}
+	set blocked {
+		type ipv4_addr
+		flags interval
+	}
+}
+`
+	got := parseDNSSets(listing)
+	if len(got) != 2 || !got["dns_bbc"] || got["dns6_bbc"] {
+		t.Errorf("parseDNSSets = %v, want dns_bbc with timeout and dns6_bbc without", got)
+	}
+}
+
+func TestPolicyRules(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy PolicyGroup
+		want   []string
+	}{
+		{
+			name:   "no matches marks everything",
+			policy: PolicyGroup{Name: "all"},
+			want:   []string{"meta mark set 7"},
+		},
+		{
+			name:   "ipv4 only",
+			policy: PolicyGroup{Name: "v4", SourceCIDRs: []string{"10.0.0.0/24"}, DestinationCIDRs: []string{"203.0.113.0/24"}},
+			want:   []string{"ip saddr { 10.0.0.0/24 } ip daddr { 203.0.113.0/24 } meta mark set 7"},
+		},
+		{
+			name:   "ipv6 only",
+			policy: PolicyGroup{Name: "v6", SourceCIDRs: []string{"fd00::/64"}},
+			want:   []string{"ip6 saddr { fd00::/64 } meta mark set 7"},
+		},
+		{
+			name:   "dual-stack destinations",
+			policy: PolicyGroup{Name: "dual", DestinationCIDRs: []string{"203.0.113.0/24", "2001:db8::/32"}},
+			want: []string{
+				"ip daddr { 203.0.113.0/24 } meta mark set 7",
+				"ip6 daddr { 2001:db8::/32 } meta mark set 7",
+			},
+		},
+		{
+			name:   "ipv4 sources with ipv6 destinations match nothing",
+			policy: PolicyGroup{Name: "mixed", SourceCIDRs: []string{"10.0.0.0/24"}, DestinationCIDRs: []string{"2001:db8::/32"}},
+			want:   nil,
+		},
+		{
+			name:   "domains only",
+			policy: PolicyGroup{Name: "bbc", Domains: []string{"bbc.co.uk"}},
+			want: []string{
+				"ip daddr @dns_bbc meta mark set 7",
+				"ip6 daddr @dns6_bbc meta mark set 7",
+			},
+		},
+		{
+			name:   "domains with ipv6 sources",
+			policy: PolicyGroup{Name: "bbc", SourceCIDRs: []string{"fd00::/64"}, Domains: []string{"bbc.co.uk"}},
+			want: []string{
+				"ip6 saddr { fd00::/64 } meta mark set 7",
+				"ip6 saddr { fd00::/64 } ip6 daddr @dns6_bbc meta mark set 7",
+			},
+		},
+		{
+			name:   "deny is not marked",
+			policy: PolicyGroup{Name: "ads", DestinationCIDRs: []string{"203.0.113.0/24"}, Domains: []string{"ads.example"}, Action: ActionDeny},
+			want:   nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := policyRules(PolicyStatus{PolicyGroup: tt.policy, Mark: 7})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("policyRules = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderElementsSkipsMissingSets(t *testing.T) {
+	nft := &NFTManager{}
+	nft.defaults()
+	elements := map[string][]SetElement{
+		"bbc":  {{IP: "192.0.2.1", Timeout: 60 * time.Second}, {IP: "2001:db8::1"}},
+		"gone": {{IP: "192.0.2.2", Timeout: 60 * time.Second}},
+	}
+	live := map[string]bool{"dns_bbc": true, "dns6_bbc": true}
+	script, missing := nft.renderElements(elements, live)
+	want := `add element inet octaroute dns_bbc { 192.0.2.1 timeout 60s }
+delete element inet octaroute dns_bbc { 192.0.2.1 }
+add element inet octaroute dns_bbc { 192.0.2.1 timeout 60s }
+add element inet octaroute dns6_bbc { 2001:db8::1 }
+`
+	if script != want {
+		t.Errorf("script =\n%s\nwant\n%s", script, want)
+	}
+	if !reflect.DeepEqual(missing, []string{"dns_gone"}) {
+		t.Errorf("missing = %q, want [dns_gone]", missing)
+	}
+}
@@ -0,0 +1,222 @@
+package routing
+
+import (
+	"context"
+	"slices"
+	"sort"
+)
+
+// Plan describes what applying a request would change relative to the
+// saved RoutingState. Building a plan never touches the kernel.
+type Plan struct {
+	Changed    bool           `json:"changed"`
+	Interfaces SetDiff        `json:"interfaces"`
+	Peers      []PeerChange   `json:"peers"`
+	Policies   []PolicyChange `json:"policies"`
+	DomainSets SetDiff        `json:"domainSets"`
+	Routes     []RouteChange  `json:"routes"`
+}
+
+// SetDiff lists names that would be added or removed.
+type SetDiff struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+// PeerChange is an egress interface whose WireGuard peer settings differ.
+type PeerChange struct {
+	Interface string     `json:"interface"`
+	Before    EgressNode `json:"before"`
+	After     EgressNode `json:"after"`
+}
+
+// Policy change kinds.
+const (
+	PolicyAdded   = "added"
+	PolicyRemoved = "removed"
+	PolicyMoved   = "moved"
+	PolicyUpdated = "updated"
+)
+
+// PolicyChange is a policy that would be added, removed, re-marked
+// ("moved") or have its matches updated.
+type PolicyChange struct {
+	Name   string        `json:"name"`
+	Change string        `json:"change"`
+	Before *PolicyStatus `json:"before,omitempty"`
+	After  *PolicyStatus `json:"after,omitempty"`
+}
+
+// Route change kinds.
+const (
+	RouteAdded   = "added"
+	RouteRemoved = "removed"
+	RouteUpdated = "updated"
+)
+
+// RouteChange is a static route that would be added, removed or sent via
+// a different next hop or node. Route is the CIDR and table it lives in.
+type RouteChange struct {
+	Route  string       `json:"route"`
+	Change string       `json:"change"`
+	Before *StaticRoute `json:"before,omitempty"`
+	After  *StaticRoute `json:"after,omitempty"`
+}
+
+// Plan computes the diff between the state saved in store and the state
+// req would produce. It holds the same lock as ApplyStored, so it never
+// sees a half-finished apply. Table allocations new nodes would receive
+// are not persisted.
+func (m *Manager) Plan(ctx context.Context, store *StateStore, req ApplyRequest) (Plan, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prev, _, err := store.Load(ctx)
+	if err != nil {
+		return Plan{}, &StateStoreError{Err: err}
+	}
+	next, err := m.buildState(ctx, req, false)
+	if err != nil {
+		return Plan{}, err
+	}
+	return diffState(prev, next), nil
+}
+
+func diffState(prev, next RoutingState) Plan {
+	plan := Plan{
+		Interfaces: SetDiff{Added: []string{}, Removed: []string{}},
+		Peers:      []PeerChange{},
+		Policies:   []PolicyChange{},
+		DomainSets: SetDiff{Added: []string{}, Removed: []string{}},
+		Routes:     []RouteChange{},
+	}
+
+	prevNodes := make(map[string]NodeStatus, len(prev.Nodes))
+	for _, node := range prev.Nodes {
+		prevNodes[node.Interface] = node
+	}
+	nextNodes := make(map[string]NodeStatus, len(next.Nodes))
+	for _, node := range next.Nodes {
+		nextNodes[node.Interface] = node
+		old, ok := prevNodes[node.Interface]
+		if !ok {
+			plan.Interfaces.Added = append(plan.Interfaces.Added, node.Interface)
+			continue
+		}
+		if !sameEgressNode(old.EgressNode, node.EgressNode) {
+			plan.Peers = append(plan.Peers, PeerChange{Interface: node.Interface, Before: old.EgressNode, After: node.EgressNode})
+		}
+	}
+	for _, node := range prev.Nodes {
+		if _, ok := nextNodes[node.Interface]; !ok {
+			plan.Interfaces.Removed = append(plan.Interfaces.Removed, node.Interface)
+		}
+	}
+
+	prevPolicies := make(map[string]PolicyStatus, len(prev.Policies))
+	for _, policy := range prev.Policies {
+		prevPolicies[policy.Name] = policy
+	}
+	nextPolicies := make(map[string]PolicyStatus, len(next.Policies))
+	for _, policy := range next.Policies {
+		policy := policy
+		nextPolicies[policy.Name] = policy
+		old, ok := prevPolicies[policy.Name]
+		switch {
+		case !ok:
+			plan.Policies = append(plan.Policies, PolicyChange{Name: policy.Name, Change: PolicyAdded, After: &policy})
+		case old.Mark != policy.Mark || old.Table != policy.Table:
+			old := old
+			plan.Policies = append(plan.Policies, PolicyChange{Name: policy.Name, Change: PolicyMoved, Before: &old, After: &policy})
+		case !samePolicyGroup(old.PolicyGroup, policy.PolicyGroup):
+			old := old
+			plan.Policies = append(plan.Policies, PolicyChange{Name: policy.Name, Change: PolicyUpdated, Before: &old, After: &policy})
+		}
+	}
+	for _, policy := range prev.Policies {
+		policy := policy
+		if _, ok := nextPolicies[policy.Name]; !ok {
+			plan.Policies = append(plan.Policies, PolicyChange{Name: policy.Name, Change: PolicyRemoved, Before: &policy})
+		}
+	}
+
+	plan.DomainSets = diffNames(domainSets(prev.Policies), domainSets(next.Policies))
+
+	prevRoutes := make(map[string]StaticRoute, len(prev.Routes))
+	for _, route := range prev.Routes {
+		prevRoutes[routeKey(route)] = route.StaticRoute
+	}
+	nextRoutes := make(map[string]bool, len(next.Routes))
+	for _, route := range next.Routes {
+		key := routeKey(route)
+		after := route.StaticRoute
+		nextRoutes[key] = true
+		old, ok := prevRoutes[key]
+		switch {
+		case !ok:
+			plan.Routes = append(plan.Routes, RouteChange{Route: key, Change: RouteAdded, After: &after})
+		case old != after:
+			plan.Routes = append(plan.Routes, RouteChange{Route: key, Change: RouteUpdated, Before: &old, After: &after})
+		}
+	}
+	for _, route := range prev.Routes {
+		key := routeKey(route)
+		before := route.StaticRoute
+		if !nextRoutes[key] {
+			plan.Routes = append(plan.Routes, RouteChange{Route: key, Change: RouteRemoved, Before: &before})
+		}
+	}
+
+	plan.Changed = len(plan.Interfaces.Added) > 0 || len(plan.Interfaces.Removed) > 0 ||
+		len(plan.Peers) > 0 || len(plan.Policies) > 0 ||
+		len(plan.DomainSets.Added) > 0 || len(plan.DomainSets.Removed) > 0 ||
+		len(plan.Routes) > 0
+	return plan
+}
+
+func sameEgressNode(a, b EgressNode) bool {
+	return a.Name == b.Name && a.Endpoint == b.Endpoint && a.PublicKey == b.PublicKey &&
+		slices.Equal(a.AllowedIPs, b.AllowedIPs) && a.LocalAddress == b.LocalAddress &&
+		a.PersistentKeepalive == b.PersistentKeepalive
+}
+
+func samePolicyGroup(a, b PolicyGroup) bool {
+	return a.Name == b.Name && a.Node == b.Node && a.Action == b.Action &&
+		a.Resolver == b.Resolver &&
+		slices.Equal(a.SourceCIDRs, b.SourceCIDRs) &&
+		slices.Equal(a.DestinationCIDRs, b.DestinationCIDRs) &&
+		slices.Equal(a.Domains, b.Domains)
+}
+
+// domainSets returns the nft set names the policies' domains populate.
+func domainSets(policies []PolicyStatus) []string {
+	var sets []string
+	for _, policy := range policies {
+		if learnsDomains(policy.PolicyGroup) {
+			sets = append(sets, dnsSetNames(policy.Name)...)
+		}
+	}
+	return sets
+}
+
+func diffNames(prev, next []string) SetDiff {
+	diff := SetDiff{Added: []string{}, Removed: []string{}}
+	prevSet := make(map[string]bool, len(prev))
+	for _, name := range prev {
+		prevSet[name] = true
+	}
+	nextSet := make(map[string]bool, len(next))
+	for _, name := range next {
+		nextSet[name] = true
+		if !prevSet[name] {
+			diff.Added = append(diff.Added, name)
+		}
+	}
+	for name := range prevSet {
+		if !nextSet[name] {
+			diff.Removed = append(diff.Removed, name)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	return diff
+}
@@ -0,0 +1,63 @@
+package routing
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPlanReportsRouteChanges(t *testing.T) {
+	ctx := context.Background()
+	store, err := OpenStateStore(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	manager := &Manager{}
+	nodes := []EgressNode{{Name: "de"}}
+	saved, err := manager.buildState(ctx, ApplyRequest{
+		Nodes: nodes,
+		Routes: []StaticRoute{
+			{CIDR: "192.168.10.0/24", NextHop: "10.42.0.1"},
+			{CIDR: "192.168.20.0/24", NextHop: "10.42.0.1"},
+			{CIDR: "192.168.30.0/24", Node: "de"},
+		},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(ctx, saved); err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := manager.Plan(ctx, store, ApplyRequest{
+		Nodes: nodes,
+		Routes: []StaticRoute{
+			{CIDR: "192.168.10.0/24", NextHop: "10.42.0.1"},
+			{CIDR: "192.168.30.0/24", NextHop: "10.42.0.9", Node: "de"},
+			{CIDR: "192.168.40.0/24", NextHop: "10.42.0.1"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RouteChange{
+		{Route: "192.168.30.0/24 table 101", Change: RouteUpdated,
+			Before: &StaticRoute{CIDR: "192.168.30.0/24", Node: "de"},
+			After:  &StaticRoute{CIDR: "192.168.30.0/24", NextHop: "10.42.0.9", Node: "de"}},
+		{Route: "192.168.40.0/24 table 0", Change: RouteAdded,
+			After: &StaticRoute{CIDR: "192.168.40.0/24", NextHop: "10.42.0.1"}},
+		{Route: "192.168.20.0/24 table 0", Change: RouteRemoved,
+			Before: &StaticRoute{CIDR: "192.168.20.0/24", NextHop: "10.42.0.1"}},
+	}
+	if !reflect.DeepEqual(plan.Routes, want) {
+		t.Errorf("route changes = %+v, want %+v", plan.Routes, want)
+	}
+	if !plan.Changed {
+		t.Error("plan with only route changes reports no changes")
+	}
+	if len(plan.Interfaces.Added)+len(plan.Interfaces.Removed)+len(plan.Peers)+len(plan.Policies) != 0 {
+		t.Errorf("unexpected non-route changes: %+v", plan)
+	}
+}
@@ -0,0 +1,261 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Drift kinds.
+const (
+	DriftInterface = "interface"
+	DriftPeer      = "peer"
+	DriftRule      = "rule"
+	DriftRoute     = "route"
+	DriftNFT       = "nftables"
+)
+
+// Drift is one difference between the kernel and the saved RoutingState.
+type Drift struct {
+	Kind   string `json:"kind"`
+	Object string `json:"object"`
+	Detail string `json:"detail"`
+}
+
+// ReconcileStatus is the outcome of the latest reconciliation pass.
+type ReconcileStatus struct {
+	CheckedAt time.Time `json:"checkedAt"`
+	Drift     []Drift   `json:"drift"`
+	Repaired  bool      `json:"repaired"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Reconciler periodically compares the live WireGuard peers, ip rules, route
+// tables, static routes and nftables ruleset with the saved RoutingState and, when Repair is
+// set, re-applies the saved state to undo any drift.
+type Reconciler struct {
+	Manager  *Manager
+	Store    *StateStore
+	Interval time.Duration
+	Repair   bool
+
+	mu     sync.Mutex
+	status ReconcileStatus
+}
+
+// Run reconciles every Interval until ctx is cancelled.
+func (r *Reconciler) Run(ctx context.Context) {
+	interval := r.Interval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		status := r.Reconcile(ctx)
+		if status.Error != "" {
+			log.Printf("reconcile: %s", status.Error)
+		}
+	}
+}
+
+// Status returns the outcome of the latest pass.
+func (r *Reconciler) Status() ReconcileStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
+
+// Reconcile runs a single pass and records its outcome.
+func (r *Reconciler) Reconcile(ctx context.Context) ReconcileStatus {
+	status := ReconcileStatus{CheckedAt: time.Now().UTC(), Drift: []Drift{}}
+	defer func() {
+		r.mu.Lock()
+		r.status = status
+		r.mu.Unlock()
+	}()
+
+	state, ok, err := r.Store.Load(ctx)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	if !ok {
+		return status
+	}
+	var nft NFTManager
+	if r.Manager.NFT != nil {
+		nft = *r.Manager.NFT
+	}
+	nft.defaults()
+	status.Drift = detectDrift(ctx, &nft, state)
+	if len(status.Drift) == 0 {
+		return status
+	}
+	for _, d := range status.Drift {
+		log.Printf("reconcile: drift in %s %s: %s", d.Kind, d.Object, d.Detail)
+	}
+	if !r.Repair {
+		return status
+	}
+	// Repair skips the state if an /apply replaced it while we were
+	// looking; the next pass checks against the new one.
+	repaired, err := r.Manager.Repair(ctx, r.Store, state.AppliedAt)
+	if err != nil {
+		status.Error = fmt.Sprintf("repair: %v", err)
+		return status
+	}
+	if !repaired {
+		return status
+	}
+	status.Repaired = true
+	log.Printf("reconcile: repaired %d drifted objects", len(status.Drift))
+	return status
+}
+
+func detectDrift(ctx context.Context, nft *NFTManager, state RoutingState) []Drift {
+	drift := []Drift{}
+	rules := make(map[string]map[[2]int]bool)
+	for _, family := range ipFamilies() {
+		live, err := liveIPRules(ctx, family)
+		if err != nil {
+			drift = append(drift, Drift{Kind: DriftRule, Object: "ip " + family + " rule", Detail: err.Error()})
+			continue
+		}
+		rules[family] = live
+	}
+	for _, node := range state.Nodes {
+		if err := run(ctx, "ip", "link", "show", node.Interface); err != nil {
+			drift = append(drift, Drift{Kind: DriftInterface, Object: node.Interface, Detail: "interface missing"})
+			continue
+		}
+		peers, err := output(ctx, "wg", "show", node.Interface, "peers")
+		if err != nil || !containsField(peers, node.PublicKey) {
+			drift = append(drift, Drift{Kind: DriftPeer, Object: node.Interface, Detail: fmt.Sprintf("peer %s missing", node.PublicKey)})
+		}
+		for _, family := range ipFamilies() {
+			routes, err := output(ctx, "ip", family, "route", "show", "table", fmt.Sprint(node.TableID))
+			if err != nil || !hasDefaultRoute(routes, node.Interface) {
+				drift = append(drift, Drift{Kind: DriftRoute, Object: fmt.Sprintf("ip %s table %d", family, node.TableID), Detail: fmt.Sprintf("default route via %s missing", node.Interface)})
+			}
+			if live, ok := rules[family]; ok && !live[[2]int{node.Mark, node.TableID}] {
+				drift = append(drift, Drift{Kind: DriftRule, Object: fmt.Sprintf("ip %s fwmark %d lookup %d", family, node.Mark, node.TableID), Detail: "rule missing"})
+			}
+		}
+	}
+	drift = append(drift, staticRouteDrift(ctx, state.Routes)...)
+	return append(drift, nftDrift(ctx, nft, state.Policies)...)
+}
+
+// staticRouteDrift checks that the static routes the last apply installed
+// are still in their tables with the same next hop. Routes that failed to
+// install are left to the next apply rather than reported on every pass.
+func staticRouteDrift(ctx context.Context, routes []RouteStatus) []Drift {
+	var drift []Drift
+	for _, route := range routes {
+		if !route.Installed {
+			continue
+		}
+		args := append([]string{"route", "show", "exact", route.CIDR}, routeTableArgs(route.Table)...)
+		listing, err := output(ctx, "ip", args...)
+		if err != nil || !hasStaticRoute(listing, route.NextHop) {
+			drift = append(drift, Drift{Kind: DriftRoute, Object: routeKey(route), Detail: "static route missing"})
+		}
+	}
+	return drift
+}
+
+func nftDrift(ctx context.Context, nft *NFTManager, policies []PolicyStatus) []Drift {
+	table := nft.Family + " " + nft.Table
+	listing, err := output(ctx, "nft", "list", "table", nft.Family, nft.Table)
+	if err != nil {
+		return []Drift{{Kind: DriftNFT, Object: table, Detail: "table missing"}}
+	}
+	var drift []Drift
+	want := 0
+	for _, policy := range policies {
+		want += len(policyRules(policy))
+	}
+	if got := strings.Count(listing, "meta mark set"); got != want {
+		drift = append(drift, Drift{Kind: DriftNFT, Object: table + " prerouting", Detail: fmt.Sprintf("chain has %d mark rules, want %d", got, want)})
+	}
+	for _, set := range domainSets(policies) {
+		if !strings.Contains(listing, "set "+set+" {") {
+			drift = append(drift, Drift{Kind: DriftNFT, Object: table + " " + set, Detail: "set missing"})
+		}
+	}
+	return drift
+}
+
+// liveIPRules returns the fwmark/lookup pairs of the installed ip rules of
+// one family ("-4" or "-6").
+func liveIPRules(ctx context.Context, family string) (map[[2]int]bool, error) {
+	listing, err := output(ctx, "ip", family, "rule", "show")
+	if err != nil {
+		return nil, err
+	}
+	rules := make(map[[2]int]bool)
+	for _, line := range strings.Split(listing, "\n") {
+		fields := strings.Fields(line)
+		mark, table := -1, -1
+		for i := 0; i+1 < len(fields); i++ {
+			switch fields[i] {
+			case "fwmark":
+				value, _, _ := strings.Cut(fields[i+1], "/")
+				if v, err := strconv.ParseInt(value, 0, 64); err == nil {
+					mark = int(v)
+				}
+			case "lookup", "table":
+				if v, err := strconv.Atoi(fields[i+1]); err == nil {
+					table = v
+				}
+			}
+		}
+		if mark >= 0 && table >= 0 {
+			rules[[2]int{mark, table}] = true
+		}
+	}
+	return rules, nil
+}
+
+// hasStaticRoute reports whether an `ip route show exact` listing has a
+// route, through nextHop when one is given.
+func hasStaticRoute(listing, nextHop string) bool {
+	for _, line := range strings.Split(listing, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if nextHop == "" || containsField(line, nextHop) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasDefaultRoute(listing, iface string) bool {
+	for _, line := range strings.Split(listing, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == "default" && containsField(line, iface) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsField(text, field string) bool {
+	for _, f := range strings.Fields(text) {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package routing
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+)
+
+func TestStaticRouteDrift(t *testing.T) {
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("checking routes needs ip")
+	}
+	routes := []RouteStatus{
+		{StaticRoute: StaticRoute{CIDR: "192.0.2.0/24", NextHop: "10.42.0.1"}, Table: 4242, Installed: true},
+		{StaticRoute: StaticRoute{CIDR: "198.51.100.0/24", NextHop: "10.42.0.1"}, Table: 4242, Error: "unreachable"},
+	}
+	drift := staticRouteDrift(context.Background(), routes)
+	if len(drift) != 1 || drift[0].Kind != DriftRoute || drift[0].Object != "192.0.2.0/24 table 4242" {
+		t.Fatalf("drift = %+v, want only the installed route missing", drift)
+	}
+}
+
+func TestHasStaticRoute(t *testing.T) {
+	listing := "192.0.2.0/24 via 10.42.0.1 dev eth0 \n"
+	tests := []struct {
+		listing string
+		nextHop string
+		want    bool
+	}{
+		{listing, "10.42.0.1", true},
+		{listing, "", true},
+		{listing, "10.42.0.9", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got := hasStaticRoute(tt.listing, tt.nextHop); got != tt.want {
+			t.Errorf("hasStaticRoute(%q, %q) = %v, want %v", tt.listing, tt.nextHop, got, tt.want)
+		}
+	}
+}
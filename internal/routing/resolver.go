@@ -0,0 +1,167 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/miekg/dns"
+
+	"octaroute/internal/netutil"
+)
+
+// ResolverEgress, as a PolicyGroup.Resolver, sends the policy's queries to
+// the proxy's own upstreams but out of the policy's egress interface, so
+// they leave from the exit node's location.
+const ResolverEgress = "egress"
+
+// defaultUpstream is used when neither Upstream nor Upstreams is set.
+const defaultUpstream = "1.1.1.1:53"
+
+// ResolverStatus reports the resolver serving one policy's domains.
+type ResolverStatus struct {
+	Policy    string           `json:"policy"`
+	Resolver  string           `json:"resolver"`
+	Interface string           `json:"interface"`
+	Upstreams []UpstreamStatus `json:"upstreams"`
+}
+
+// policyResolver is the upstream a policy's queries go to, with sockets
+// bound to the egress interface and marked with its fwmark.
+type policyResolver struct {
+	resolver  string
+	iface     string
+	upstreams *upstreamPool
+}
+
+// validateResolver checks a policy's resolver setting without connecting.
+func validateResolver(policy PolicyGroup) error {
+	if policy.Resolver == "" || policy.Resolver == ResolverEgress {
+		return nil
+	}
+	upstream, err := ParseUpstream(policy.Resolver, UpstreamOptions{})
+	if err != nil {
+		return fmt.Errorf("policy %s resolver: %w", policy.Name, err)
+	}
+	return upstream.Close()
+}
+
+func (p *DNSProxy) upstreamURIs() []string {
+	if len(p.Upstreams) > 0 {
+		return p.Upstreams
+	}
+	if p.Upstream == "" {
+		return []string{defaultUpstream}
+	}
+	return []string{p.Upstream}
+}
+
+// newPolicyResolvers builds the resolvers of the policies that set one,
+// keyed by policy. Policies on the same egress node with the same resolver
+// share it.
+func (p *DNSProxy) newPolicyResolvers(policies []PolicyStatus, nodes []NodeStatus) (map[string]*policyResolver, error) {
+	resolvers := make(map[string]*policyResolver)
+	shared := make(map[string]*policyResolver)
+	closeAll := func() {
+		for _, resolver := range shared {
+			_ = resolver.upstreams.Close()
+		}
+	}
+	for _, policy := range policies {
+		if policy.Resolver == "" {
+			continue
+		}
+		var node *NodeStatus
+		for i := range nodes {
+			if nodes[i].TableID == policy.Table {
+				node = &nodes[i]
+				break
+			}
+		}
+		if node == nil {
+			closeAll()
+			return nil, fmt.Errorf("policy %s: resolver %q needs an egress node", policy.Name, policy.Resolver)
+		}
+		key := node.Interface + " " + policy.Resolver
+		if resolver, ok := shared[key]; ok {
+			resolvers[policy.Name] = resolver
+			continue
+		}
+		uris, strategy := p.upstreamURIs(), p.Strategy
+		if policy.Resolver != ResolverEgress {
+			uris, strategy = []string{policy.Resolver}, StrategyFailover
+		}
+		opts := UpstreamOptions{
+			TLSConfig: p.TLSConfig,
+			Dialer:    &net.Dialer{Control: netutil.DeviceControl(node.Interface, node.Mark)},
+		}
+		upstreams, err := newUpstreamPool(uris, strategy, opts)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("policy %s resolver: %w", policy.Name, err)
+		}
+		resolver := &policyResolver{resolver: policy.Resolver, iface: node.Interface, upstreams: upstreams}
+		shared[key] = resolver
+		resolvers[policy.Name] = resolver
+	}
+	return resolvers, nil
+}
+
+// setPolicyResolvers swaps in resolvers, starts their health probes and
+// closes the ones they replace. p.mu must be held.
+func (p *DNSProxy) setPolicyResolvers(resolvers map[string]*policyResolver) {
+	if p.stopResolvers != nil {
+		p.stopResolvers()
+		p.stopResolvers = nil
+	}
+	closed := make(map[*policyResolver]bool)
+	for _, resolver := range p.resolvers {
+		if !closed[resolver] {
+			closed[resolver] = true
+			_ = resolver.upstreams.Close()
+		}
+	}
+	p.resolvers = resolvers
+	if len(resolvers) == 0 {
+		return
+	}
+	var ctx context.Context
+	ctx, p.stopResolvers = context.WithCancel(context.Background())
+	started := make(map[*policyResolver]bool)
+	for _, resolver := range resolvers {
+		if !started[resolver] {
+			started[resolver] = true
+			go resolver.upstreams.Run(ctx, p.HealthInterval)
+		}
+	}
+}
+
+// upstreamFor returns the upstream a question goes to: the resolver of the
+// policy matching it, if that policy has one, or the proxy's upstreams.
+func (p *DNSProxy) upstreamFor(r *dns.Msg) Upstream {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(r.Question) > 0 && len(p.resolvers) > 0 && p.domains != nil {
+		if policy, ok := p.domains.Lookup(r.Question[0].Name); ok {
+			if resolver, ok := p.resolvers[policy]; ok {
+				return resolver.upstreams
+			}
+		}
+	}
+	return p.upstreams
+}
+
+func (p *DNSProxy) resolverStatus() []ResolverStatus {
+	statuses := make([]ResolverStatus, 0, len(p.resolvers))
+	for policy, resolver := range p.resolvers {
+		statuses = append(statuses, ResolverStatus{
+			Policy:    policy,
+			Resolver:  resolver.resolver,
+			Interface: resolver.iface,
+			Upstreams: resolver.upstreams.Status(),
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Policy < statuses[j].Policy })
+	return statuses
+}
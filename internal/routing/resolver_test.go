@@ -0,0 +1,59 @@
+package routing
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestPolicyResolverRoutesMatchingQueries(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("binding sockets to an interface needs root")
+	}
+	local, _ := startStandIn(t, "udp", nil)
+	egress, _ := startStandIn(t, "udp", nil)
+	proxy := &DNSProxy{ListenAddr: "127.0.0.1:0", Upstream: local}
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Stop(context.Background())
+
+	nodes := []NodeStatus{{EgressNode: EgressNode{Name: "uk"}, Interface: "lo", TableID: 101}}
+	policies := []PolicyStatus{
+		{PolicyGroup: PolicyGroup{Name: "bbc", Domains: []string{"*.bbc.co.uk"}, Resolver: "udp://" + egress}, Table: 101},
+		{PolicyGroup: PolicyGroup{Name: "other", Domains: []string{"example.org"}}, Table: 101},
+	}
+	if err := proxy.UpdatePolicies(policies, nodes); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"www.bbc.co.uk.", "example.org.", "example.com."} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		if _, err := proxy.resolve(msg); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	resolvers := proxy.resolverStatus()
+	if len(resolvers) != 1 || resolvers[0].Policy != "bbc" || resolvers[0].Interface != "lo" {
+		t.Fatalf("resolvers = %+v", resolvers)
+	}
+	if got := resolvers[0].Upstreams[0].Queries; got != 1 {
+		t.Errorf("policy resolver answered %d queries, want 1", got)
+	}
+	if got := proxy.upstreams.Status()[0].Queries; got != 2 {
+		t.Errorf("local upstream answered %d queries, want 2", got)
+	}
+}
+
+func TestPolicyResolverNeedsEgressNode(t *testing.T) {
+	proxy := &DNSProxy{}
+	policies := []PolicyStatus{{PolicyGroup: PolicyGroup{Name: "bbc", Resolver: ResolverEgress}, Table: 101}}
+	if err := proxy.UpdatePolicies(policies, nil); err == nil {
+		t.Fatal("resolver without an egress node accepted")
+	}
+	if err := validateResolver(PolicyGroup{Name: "bbc", Resolver: "quic://10.0.0.1"}); err == nil {
+		t.Fatal("unsupported resolver URI accepted")
+	}
+}
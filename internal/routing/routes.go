@@ -0,0 +1,87 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// buildRoutes resolves each route's table: a route bound to a node goes
+// into that node's egress table, any other route into the main table.
+func buildRoutes(routes []StaticRoute, nodeAllocs map[string]TableAllocation) ([]RouteStatus, error) {
+	statuses := make([]RouteStatus, 0, len(routes))
+	for _, route := range routes {
+		if _, _, err := net.ParseCIDR(route.CIDR); err != nil {
+			return nil, fmt.Errorf("route %s: invalid cidr", route.CIDR)
+		}
+		if route.NextHop != "" && net.ParseIP(route.NextHop) == nil {
+			return nil, fmt.Errorf("route %s: invalid next hop %s", route.CIDR, route.NextHop)
+		}
+		status := RouteStatus{StaticRoute: route}
+		if route.Node != "" {
+			alloc, ok := nodeAllocs[route.Node]
+			if !ok {
+				return nil, fmt.Errorf("unknown node %s for route %s", route.Node, route.CIDR)
+			}
+			status.Table = alloc.TableID
+		} else if route.NextHop == "" {
+			return nil, fmt.Errorf("route %s: needs a next hop or a node", route.CIDR)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// ensureRoutes installs each route with `ip route replace`, recording the
+// outcome on the route rather than failing the apply, so one unreachable
+// next hop does not take the rest of the gateway down with it.
+func ensureRoutes(ctx context.Context, nodes []NodeStatus, routes []RouteStatus) {
+	ifaces := make(map[string]string, len(nodes))
+	for _, node := range nodes {
+		ifaces[node.Name] = node.Interface
+	}
+	for i := range routes {
+		route := &routes[i]
+		args := []string{"route", "replace", route.CIDR}
+		if route.NextHop != "" {
+			args = append(args, "via", route.NextHop)
+		}
+		if iface := ifaces[route.Node]; iface != "" {
+			args = append(args, "dev", iface)
+		}
+		args = append(args, routeTableArgs(route.Table)...)
+		if err := run(ctx, "ip", args...); err != nil {
+			route.Installed, route.Error = false, err.Error()
+			continue
+		}
+		route.Installed, route.Error = true, ""
+	}
+}
+
+// removeStaleRoutes deletes the installed routes of prev that next does not
+// keep in the same table.
+func removeStaleRoutes(ctx context.Context, prev, next []RouteStatus) {
+	keep := make(map[string]bool, len(next))
+	for _, route := range next {
+		keep[routeKey(route)] = true
+	}
+	for _, route := range prev {
+		if !route.Installed || keep[routeKey(route)] {
+			continue
+		}
+		args := append([]string{"route", "del", route.CIDR}, routeTableArgs(route.Table)...)
+		// The route may already be gone with its interface or table.
+		_ = run(ctx, "ip", args...)
+	}
+}
+
+func routeKey(route RouteStatus) string {
+	return fmt.Sprintf("%s table %d", route.CIDR, route.Table)
+}
+
+func routeTableArgs(table int) []string {
+	if table == 0 {
+		return nil
+	}
+	return []string{"table", fmt.Sprint(table)}
+}
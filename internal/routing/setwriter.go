@@ -0,0 +1,130 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultBatchWindow is how long the set writer waits after the first
+// queued address before flushing, to coalesce the addresses of concurrent
+// answers into one nft transaction.
+const DefaultBatchWindow = 10 * time.Millisecond
+
+// setWriter takes DNS-learned addresses off the query path. Addresses are
+// queued, coalesced per set (a repeat keeps the longest timeout) and written
+// together with NFTManager.AddDomainElements.
+type setWriter struct {
+	nft    *NFTManager
+	window time.Duration
+
+	mu      sync.Mutex
+	pending map[setKey]*pendingElement
+	kick    chan struct{}
+}
+
+type setKey struct {
+	policy string
+	ip     string
+}
+
+type pendingElement struct {
+	timeout time.Duration
+	done    []func(error)
+}
+
+func newSetWriter(nft *NFTManager, window time.Duration) *setWriter {
+	if window <= 0 {
+		window = DefaultBatchWindow
+	}
+	return &setWriter{
+		nft:     nft,
+		window:  window,
+		pending: make(map[setKey]*pendingElement),
+		kick:    make(chan struct{}, 1),
+	}
+}
+
+// Add queues ip for policy's set. done, if not nil, is called with the
+// outcome once the batch holding ip has been written.
+func (w *setWriter) Add(policy, ip string, timeout time.Duration, done func(error)) {
+	if net.ParseIP(ip) == nil {
+		if done != nil {
+			done(nil)
+		}
+		return
+	}
+	w.mu.Lock()
+	key := setKey{policy: policy, ip: ip}
+	element, ok := w.pending[key]
+	if !ok {
+		element = &pendingElement{}
+		w.pending[key] = element
+	}
+	if timeout > element.timeout {
+		element.timeout = timeout
+	}
+	if done != nil {
+		element.done = append(element.done, done)
+	}
+	w.mu.Unlock()
+	select {
+	case w.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Run flushes queued addresses until ctx is cancelled.
+func (w *setWriter) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			w.flush(context.Background())
+			return
+		case <-w.kick:
+		}
+		timer := time.NewTimer(w.window)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+		case <-timer.C:
+		}
+		w.flush(ctx)
+	}
+}
+
+func (w *setWriter) flush(ctx context.Context) {
+	w.mu.Lock()
+	batch := w.pending
+	w.pending = make(map[setKey]*pendingElement)
+	w.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+	elements := make(map[string][]SetElement)
+	for key, element := range batch {
+		elements[key.policy] = append(elements[key.policy], SetElement{IP: key.ip, Timeout: element.timeout})
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	missing, err := w.nft.AddDomainElements(ctx, elements)
+	if err != nil {
+		log.Printf("dns: write %d learned addresses: %v", len(batch), err)
+	}
+	dropped := make(map[string]bool, len(missing))
+	for _, set := range missing {
+		dropped[set] = true
+	}
+	for key, element := range batch {
+		result := err
+		if set := dnsSetName(key.policy, key.ip); dropped[set] {
+			result = fmt.Errorf("set %s: %w", set, ErrSetMissing)
+		}
+		for _, done := range element.done {
+			done(result)
+		}
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+
+	"octaroute/internal/migrate"
 )
 
 type StateStore struct {
@@ -31,20 +33,31 @@ func (s *StateStore) Close() error {
 	return s.db.Close()
 }
 
-func (s *StateStore) migrate(ctx context.Context) error {
-	schema := `
+// stateMigrations is the ordered routing state schema history. Append new
+// entries; never edit one that has shipped.
+var stateMigrations = []migrate.Migration{
+	{Version: 1, Name: "routing state", Up: migrate.Exec(`
     CREATE TABLE IF NOT EXISTS routing_state (
         id INTEGER PRIMARY KEY CHECK (id = 1),
         payload TEXT NOT NULL,
         updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
     );
-    `
-	if _, err := s.db.ExecContext(ctx, schema); err != nil {
-		return fmt.Errorf("apply routing_state schema: %w", err)
+    `)},
+	{Version: 2, Name: "table allocations", Up: migrateTableAllocations},
+}
+
+func (s *StateStore) migrate(ctx context.Context) error {
+	if _, err := migrate.Apply(ctx, s.db, stateMigrations); err != nil {
+		return fmt.Errorf("migrate routing state db: %w", err)
 	}
 	return nil
 }
 
+// SchemaVersion reports the schema migration the database is at.
+func (s *StateStore) SchemaVersion(ctx context.Context) (int, error) {
+	return migrate.Version(ctx, s.db)
+}
+
 func (s *StateStore) Save(ctx context.Context, state RoutingState) error {
 	payload, err := json.Marshal(state)
 	if err != nil {
@@ -74,5 +87,11 @@ func (s *StateStore) Load(ctx context.Context) (RoutingState, bool, error) {
 	if err := json.Unmarshal([]byte(payload), &state); err != nil {
 		return RoutingState{}, false, fmt.Errorf("unmarshal routing state: %w", err)
 	}
+	for i := range state.Nodes {
+		// States saved before nodes had their own mark used the table ID.
+		if state.Nodes[i].Mark == 0 {
+			state.Nodes[i].Mark = state.Nodes[i].TableID
+		}
+	}
 	return state, true, nil
 }
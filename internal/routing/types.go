@@ -17,6 +17,13 @@ type EgressNode struct {
 	PersistentKeepalive int      `json:"persistentKeepalive"`
 }
 
+// Policy actions. Traffic of allow policies is marked for their egress node;
+// deny policies with domains are blocked by the DNS proxy.
+const (
+	ActionAllow = "allow"
+	ActionDeny  = "deny"
+)
+
 type PolicyGroup struct {
 	Name             string   `json:"name"`
 	Node             string   `json:"node"`
@@ -24,6 +31,11 @@ type PolicyGroup struct {
 	DestinationCIDRs []string `json:"destinationCidrs"`
 	Domains          []string `json:"domains"`
 	Action           string   `json:"action"`
+	// Resolver sends queries for Domains through the policy's egress
+	// interface: ResolverEgress uses the DNS proxy's upstreams, an
+	// upstream URI (e.g. a resolver on the exit node) uses that resolver.
+	// Empty resolves them locally like any other name.
+	Resolver string `json:"resolver,omitempty"`
 }
 
 type StaticRoute struct {
@@ -36,13 +48,33 @@ type RoutingState struct {
 	AppliedAt time.Time      `json:"appliedAt"`
 	Nodes     []NodeStatus   `json:"nodes"`
 	Policies  []PolicyStatus `json:"policies"`
-	Routes    []StaticRoute  `json:"routes"`
+	Routes    []RouteStatus  `json:"routes"`
+}
+
+// Request rebuilds the ApplyRequest that produced the state.
+func (s RoutingState) Request() ApplyRequest {
+	req := ApplyRequest{
+		Nodes:    make([]EgressNode, 0, len(s.Nodes)),
+		Policies: make([]PolicyGroup, 0, len(s.Policies)),
+		Routes:   make([]StaticRoute, 0, len(s.Routes)),
+	}
+	for _, node := range s.Nodes {
+		req.Nodes = append(req.Nodes, node.EgressNode)
+	}
+	for _, policy := range s.Policies {
+		req.Policies = append(req.Policies, policy.PolicyGroup)
+	}
+	for _, route := range s.Routes {
+		req.Routes = append(req.Routes, route.StaticRoute)
+	}
+	return req
 }
 
 type NodeStatus struct {
 	EgressNode
 	Interface string `json:"interface"`
 	TableID   int    `json:"tableId"`
+	Mark      int    `json:"mark"`
 }
 
 type PolicyStatus struct {
@@ -51,3 +83,12 @@ type PolicyStatus struct {
 	Table  int  `json:"table"`
 	Active bool `json:"active"`
 }
+
+// RouteStatus is a StaticRoute with the table it belongs in (0 for the main
+// table) and the outcome of installing it.
+type RouteStatus struct {
+	StaticRoute
+	Table     int    `json:"table"`
+	Installed bool   `json:"installed"`
+	Error     string `json:"error,omitempty"`
+}
@@ -0,0 +1,307 @@
+package routing
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Upstream is a resolver the DNS proxy forwards queries to.
+type Upstream interface {
+	Exchange(ctx context.Context, query *dns.Msg) (*dns.Msg, error)
+	// Close releases pooled connections.
+	Close() error
+	String() string
+}
+
+const (
+	upstreamTimeout = 5 * time.Second
+	// upstreamIdleConns is how many idle connections a TCP, TLS or HTTPS
+	// upstream keeps open for reuse.
+	upstreamIdleConns = 4
+)
+
+// UpstreamOptions control how an upstream connects.
+type UpstreamOptions struct {
+	// TLSConfig is used for tls:// and https:// upstreams; its ServerName
+	// defaults to the URI's host.
+	TLSConfig *tls.Config
+	// Dialer opens the upstream's sockets, e.g. bound to an egress
+	// interface; a plain dialer when nil.
+	Dialer *net.Dialer
+}
+
+// ParseUpstream parses an upstream URI:
+//
+//	udp://1.1.1.1:53       plain DNS over UDP, retried over TCP when truncated
+//	tcp://1.1.1.1:53       plain DNS over TCP
+//	tls://1.1.1.1:853      DNS over TLS (RFC 7858)
+//	https://1.1.1.1/dns-query  DNS over HTTPS (RFC 8484)
+//
+// A bare host:port is taken as udp://. Ports default to 53, 853 and 443,
+// and the DoH path to /dns-query.
+func ParseUpstream(raw string, opts UpstreamOptions) (Upstream, error) {
+	uri := raw
+	if !strings.Contains(uri, "://") {
+		uri = "udp://" + uri
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("parse upstream %q: %w", raw, err)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("upstream %q has no host", raw)
+	}
+	dialer := opts.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	if dialer.Timeout == 0 {
+		d := *dialer
+		d.Timeout = upstreamTimeout
+		dialer = &d
+	}
+	switch u.Scheme {
+	case "udp":
+		return &plainUpstream{uri: uri, addr: hostPort(u, "53"), dialer: dialer}, nil
+	case "tcp":
+		return newStreamUpstream(uri, hostPort(u, "53"), dialer, nil), nil
+	case "tls":
+		return newStreamUpstream(uri, hostPort(u, "853"), dialer, upstreamTLSConfig(opts.TLSConfig, u)), nil
+	case "https":
+		return newDoHUpstream(u, dialer, upstreamTLSConfig(opts.TLSConfig, u)), nil
+	default:
+		return nil, fmt.Errorf("upstream %q: unsupported scheme %q", raw, u.Scheme)
+	}
+}
+
+func hostPort(u *url.URL, defaultPort string) string {
+	port := u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+func upstreamTLSConfig(base *tls.Config, u *url.URL) *tls.Config {
+	cfg := &tls.Config{}
+	if base != nil {
+		cfg = base.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = u.Hostname()
+	}
+	if cfg.MinVersion == 0 {
+		cfg.MinVersion = tls.VersionTLS12
+	}
+	return cfg
+}
+
+// plainUpstream is classic DNS over UDP with TCP fallback.
+type plainUpstream struct {
+	uri    string
+	addr   string
+	dialer *net.Dialer
+}
+
+func (u *plainUpstream) String() string {
+	return u.uri
+}
+
+func (u *plainUpstream) Close() error {
+	return nil
+}
+
+func (u *plainUpstream) Exchange(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	client := &dns.Client{Net: "udp", Timeout: upstreamTimeout, UDPSize: upstreamUDPSize, Dialer: u.dialer}
+	resp, _, err := client.ExchangeContext(ctx, query, u.addr)
+	if err == nil && resp.Truncated {
+		client.Net = "tcp"
+		resp, _, err = client.ExchangeContext(ctx, query, u.addr)
+	}
+	return resp, err
+}
+
+// streamUpstream is DNS over TCP or, with a TLS config, over TLS. Idle
+// connections are pooled and reused for later queries.
+type streamUpstream struct {
+	uri       string
+	addr      string
+	dialer    *net.Dialer
+	tlsConfig *tls.Config
+	idle      chan *dns.Conn
+}
+
+func newStreamUpstream(uri, addr string, dialer *net.Dialer, tlsConfig *tls.Config) *streamUpstream {
+	return &streamUpstream{
+		uri:       uri,
+		addr:      addr,
+		dialer:    dialer,
+		tlsConfig: tlsConfig,
+		idle:      make(chan *dns.Conn, upstreamIdleConns),
+	}
+}
+
+func (u *streamUpstream) String() string {
+	return u.uri
+}
+
+func (u *streamUpstream) Close() error {
+	for {
+		select {
+		case conn := <-u.idle:
+			_ = conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (u *streamUpstream) Exchange(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	for attempt := 0; ; attempt++ {
+		conn, reused, err := u.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := u.roundTrip(ctx, conn, query)
+		if err == nil {
+			u.put(conn)
+			return resp, nil
+		}
+		_ = conn.Close()
+		// The server may have closed a pooled connection while it sat
+		// idle; retry once on a fresh one.
+		if !reused || attempt > 0 {
+			return nil, err
+		}
+	}
+}
+
+func (u *streamUpstream) get(ctx context.Context) (*dns.Conn, bool, error) {
+	select {
+	case conn := <-u.idle:
+		return conn, true, nil
+	default:
+	}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if u.tlsConfig != nil {
+		conn, err = (&tls.Dialer{NetDialer: u.dialer, Config: u.tlsConfig}).DialContext(ctx, "tcp", u.addr)
+	} else {
+		conn, err = u.dialer.DialContext(ctx, "tcp", u.addr)
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("dial %s: %w", u.uri, err)
+	}
+	return &dns.Conn{Conn: conn}, false, nil
+}
+
+func (u *streamUpstream) put(conn *dns.Conn) {
+	select {
+	case u.idle <- conn:
+	default:
+		_ = conn.Close()
+	}
+}
+
+func (u *streamUpstream) roundTrip(ctx context.Context, conn *dns.Conn, query *dns.Msg) (*dns.Msg, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(upstreamTimeout)
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	if err := conn.WriteMsg(query); err != nil {
+		return nil, err
+	}
+	resp, err := conn.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	if resp.Id != query.Id {
+		return nil, fmt.Errorf("%s: reply id %d does not match query id %d", u.uri, resp.Id, query.Id)
+	}
+	return resp, nil
+}
+
+// dohUpstream is DNS over HTTPS. The HTTP transport keeps connections alive
+// and uses HTTP/2 when the server offers it.
+type dohUpstream struct {
+	uri    string
+	client *http.Client
+}
+
+func newDoHUpstream(u *url.URL, dialer *net.Dialer, tlsConfig *tls.Config) *dohUpstream {
+	endpoint := *u
+	if endpoint.Path == "" {
+		endpoint.Path = "/dns-query"
+	}
+	return &dohUpstream{
+		uri: endpoint.String(),
+		client: &http.Client{
+			Timeout: upstreamTimeout,
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				TLSClientConfig:     tlsConfig,
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: upstreamIdleConns,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		},
+	}
+}
+
+func (u *dohUpstream) String() string {
+	return u.uri
+}
+
+func (u *dohUpstream) Close() error {
+	u.client.CloseIdleConnections()
+	return nil
+}
+
+func (u *dohUpstream) Exchange(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	// RFC 8484 asks for ID 0 so identical queries are cacheable.
+	msg := query.Copy()
+	msg.Id = 0
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("pack query: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.uri, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	httpResp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", u.uri, httpResp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, fmt.Errorf("%s: read reply: %w", u.uri, err)
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, fmt.Errorf("%s: unpack reply: %w", u.uri, err)
+	}
+	resp.Id = query.Id
+	return resp, nil
+}
@@ -0,0 +1,409 @@
+package routing
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// standInHandler answers every A query with 192.0.2.1.
+func standInHandler(w dns.ResponseWriter, r *dns.Msg) {
+	_ = w.WriteMsg(standInReply(r))
+}
+
+func standInReply(r *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(r)
+	if len(r.Question) > 0 && r.Question[0].Qtype == dns.TypeA {
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP("192.0.2.1"),
+		})
+	}
+	return resp
+}
+
+func startStandIn(t *testing.T, network string, tlsConfig *tls.Config) (string, *atomic.Int32) {
+	t.Helper()
+	var conns atomic.Int32
+	server := &dns.Server{Net: network, TLSConfig: tlsConfig, Handler: dns.HandlerFunc(standInHandler)}
+	var addr string
+	switch network {
+	case "udp":
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.PacketConn = pc
+		addr = pc.LocalAddr().String()
+	default:
+		var (
+			l   net.Listener
+			err error
+		)
+		if tlsConfig != nil {
+			l, err = tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+		} else {
+			l, err = net.Listen("tcp", "127.0.0.1:0")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.Listener = countingListener{Listener: l, accepted: &conns}
+		addr = l.Addr().String()
+	}
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = server.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = server.Shutdown() })
+	return addr, &conns
+}
+
+type countingListener struct {
+	net.Listener
+	accepted *atomic.Int32
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+// selfSigned returns a server config for 127.0.0.1 and a client config
+// that trusts it.
+func selfSigned(t *testing.T) (server, client *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "stand-in resolver"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	return server, &tls.Config{RootCAs: roots}
+}
+
+func query(t *testing.T, upstream Upstream, name string) *dns.Msg {
+	t.Helper()
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := upstream.Exchange(ctx, msg)
+	if err != nil {
+		t.Fatalf("%s: exchange: %v", upstream, err)
+	}
+	if resp.Id != msg.Id {
+		t.Fatalf("%s: reply id %d, want %d", upstream, resp.Id, msg.Id)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Fatalf("%s: unexpected answer %v", upstream, resp.Answer)
+	}
+	return resp
+}
+
+func TestParseUpstream(t *testing.T) {
+	for raw, want := range map[string]string{
+		"1.1.1.1:53":                   "udp://1.1.1.1:53",
+		"udp://1.1.1.1":                "udp://1.1.1.1",
+		"tls://1.1.1.1":                "tls://1.1.1.1",
+		"https://dns.example/resolve":  "https://dns.example/resolve",
+		"https://dns.example":          "https://dns.example/dns-query",
+		"tcp://[2606:4700::1111]:5353": "tcp://[2606:4700::1111]:5353",
+	} {
+		upstream, err := ParseUpstream(raw, UpstreamOptions{})
+		if err != nil {
+			t.Errorf("ParseUpstream(%q): %v", raw, err)
+			continue
+		}
+		if got := upstream.String(); got != want {
+			t.Errorf("ParseUpstream(%q) = %s, want %s", raw, got, want)
+		}
+	}
+	for _, raw := range []string{"quic://1.1.1.1", "tls://", "https:///dns-query"} {
+		if _, err := ParseUpstream(raw, UpstreamOptions{}); err == nil {
+			t.Errorf("ParseUpstream(%q) succeeded, want error", raw)
+		}
+	}
+}
+
+func TestPlainUpstreams(t *testing.T) {
+	udpAddr, _ := startStandIn(t, "udp", nil)
+	tcpAddr, conns := startStandIn(t, "tcp", nil)
+	for _, uri := range []string{udpAddr, "tcp://" + tcpAddr} {
+		upstream, err := ParseUpstream(uri, UpstreamOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		query(t, upstream, "example.com")
+		query(t, upstream, "example.org")
+		_ = upstream.Close()
+	}
+	if got := conns.Load(); got != 1 {
+		t.Errorf("tcp upstream opened %d connections, want 1", got)
+	}
+}
+
+func TestDoTUpstreamPoolsConnections(t *testing.T) {
+	serverTLS, clientTLS := selfSigned(t)
+	addr, conns := startStandIn(t, "tcp-tls", serverTLS)
+	upstream, err := ParseUpstream("tls://"+addr, UpstreamOptions{TLSConfig: clientTLS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	for i := 0; i < 5; i++ {
+		query(t, upstream, "example.com")
+	}
+	if got := conns.Load(); got != 1 {
+		t.Errorf("opened %d connections for 5 sequential queries, want 1", got)
+	}
+}
+
+func TestDoTUpstreamRejectsUntrustedCert(t *testing.T) {
+	serverTLS, _ := selfSigned(t)
+	addr, _ := startStandIn(t, "tcp-tls", serverTLS)
+	upstream, err := ParseUpstream("tls://"+addr, UpstreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	if _, err := upstream.Exchange(context.Background(), msg); err == nil {
+		t.Fatal("exchange with an untrusted certificate succeeded")
+	}
+}
+
+func TestDoHUpstream(t *testing.T) {
+	var conns atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/dns-query" || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		msg := new(dns.Msg)
+		if err := msg.Unpack(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if msg.Id != 0 {
+			http.Error(w, "query id not zero", http.StatusBadRequest)
+			return
+		}
+		packed, _ := standInReply(msg).Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(packed)
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	upstream, err := ParseUpstream(server.URL, UpstreamOptions{TLSConfig: &tls.Config{RootCAs: roots}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	for i := 0; i < 5; i++ {
+		query(t, upstream, "example.com")
+	}
+	if got := conns.Load(); got != 1 {
+		t.Errorf("opened %d connections for 5 sequential queries, want 1", got)
+	}
+}
+
+func TestDNSProxyForwardsOverTLS(t *testing.T) {
+	serverTLS, clientTLS := selfSigned(t)
+	addr, _ := startStandIn(t, "tcp-tls", serverTLS)
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen := l.LocalAddr().String()
+	_ = l.Close()
+
+	proxy := &DNSProxy{ListenAddr: listen, Upstream: "tls://" + addr, TLSConfig: clientTLS}
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Stop(context.Background())
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	client := &dns.Client{Timeout: time.Second}
+	var resp *dns.Msg
+	for i := 0; i < 20; i++ {
+		if resp, _, err = client.Exchange(msg, listen); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || resp.IsEdns0() != nil {
+		t.Fatalf("unexpected reply %v", resp)
+	}
+}
+
+func TestDNSProxyRejectsBadUpstream(t *testing.T) {
+	proxy := &DNSProxy{ListenAddr: "127.0.0.1:0", Upstream: "quic://1.1.1.1"}
+	if err := proxy.Start(); err == nil {
+		_ = proxy.Stop(context.Background())
+		t.Fatal("Start with an unsupported upstream scheme succeeded")
+	}
+}
+
+// deadUpstream returns the address of a UDP socket that never answers.
+func deadUpstream(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	return pc.LocalAddr().String()
+}
+
+func TestUpstreamPoolFailsOver(t *testing.T) {
+	live, _ := startStandIn(t, "udp", nil)
+	dead := deadUpstream(t)
+	pool, err := newUpstreamPool([]string{dead, live}, StrategyFailover, UpstreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	if got := pool.Primary(); got != pool.members[0].String() {
+		t.Errorf("primary before failover = %s, want the first upstream", got)
+	}
+	for i := 0; i < upstreamDownAfter; i++ {
+		query(t, pool, "example.com")
+	}
+	if got := pool.Primary(); got != pool.members[1].String() {
+		t.Errorf("primary after failover = %s, want the live upstream", got)
+	}
+	statuses := pool.Status()
+	if statuses[0].Healthy || statuses[0].Errors != upstreamDownAfter || statuses[0].DownSince == nil {
+		t.Errorf("dead upstream status %+v, want marked down after %d errors", statuses[0], upstreamDownAfter)
+	}
+	if !statuses[1].Healthy || statuses[1].Queries != upstreamDownAfter || statuses[1].LatencyMillis <= 0 {
+		t.Errorf("live upstream status %+v", statuses[1])
+	}
+
+	// Once down, the dead upstream is tried last and no longer delays queries.
+	started := time.Now()
+	query(t, pool, "example.com")
+	if elapsed := time.Since(started); elapsed > upstreamAttemptTimeout/2 {
+		t.Errorf("query took %s with the first upstream marked down", elapsed)
+	}
+	if got := pool.Status()[0].Errors; got != upstreamDownAfter {
+		t.Errorf("down upstream was queried again: %d errors", got)
+	}
+}
+
+func TestUpstreamPoolProbeRestoresUpstream(t *testing.T) {
+	live, _ := startStandIn(t, "udp", nil)
+	pool, err := newUpstreamPool([]string{live}, StrategyFailover, UpstreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	m := pool.members[0]
+	for i := 0; i < upstreamDownAfter; i++ {
+		m.observe(0, io.ErrUnexpectedEOF)
+	}
+	if pool.Status()[0].Healthy {
+		t.Fatal("upstream not marked down")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go pool.Run(ctx, 10*time.Millisecond)
+	deadline := time.Now().Add(2 * time.Second)
+	for !pool.Status()[0].Healthy {
+		if time.Now().After(deadline) {
+			t.Fatal("probe did not mark the upstream up again")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUpstreamPoolRoundRobin(t *testing.T) {
+	a, _ := startStandIn(t, "udp", nil)
+	b, _ := startStandIn(t, "udp", nil)
+	pool, err := newUpstreamPool([]string{a, b}, StrategyRoundRobin, UpstreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	for i := 0; i < 4; i++ {
+		query(t, pool, "example.com")
+	}
+	for _, status := range pool.Status() {
+		if status.Queries != 2 {
+			t.Errorf("%s answered %d of 4 queries, want 2", status.URI, status.Queries)
+		}
+	}
+}
+
+func TestUpstreamPoolFastest(t *testing.T) {
+	a, _ := startStandIn(t, "udp", nil)
+	b, _ := startStandIn(t, "udp", nil)
+	pool, err := newUpstreamPool([]string{a, b}, StrategyFastest, UpstreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	pool.members[0].observe(50*time.Millisecond, nil)
+	pool.members[1].observe(time.Millisecond, nil)
+	query(t, pool, "example.com")
+	if got := pool.Status()[1].Queries; got != 1 {
+		t.Errorf("fastest upstream answered %d queries, want 1", got)
+	}
+}
+
+func TestUpstreamPoolRejectsUnknownStrategy(t *testing.T) {
+	if _, err := newUpstreamPool([]string{"1.1.1.1:53"}, "random", UpstreamOptions{}); err == nil {
+		t.Fatal("unknown strategy accepted")
+	}
+}
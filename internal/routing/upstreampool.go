@@ -0,0 +1,304 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Upstream selection strategies.
+const (
+	// StrategyFailover tries upstreams in the configured order.
+	StrategyFailover = "failover"
+	// StrategyRoundRobin rotates the first upstream tried per query.
+	StrategyRoundRobin = "round-robin"
+	// StrategyFastest tries the upstream with the lowest average latency
+	// first.
+	StrategyFastest = "fastest"
+)
+
+// DefaultHealthInterval is how often upstreams are probed when
+// DNSProxy.HealthInterval is zero.
+const DefaultHealthInterval = 30 * time.Second
+
+const (
+	// upstreamDownAfter consecutive failures mark an upstream down until a
+	// query or probe succeeds again.
+	upstreamDownAfter = 3
+	// upstreamAttemptTimeout bounds one upstream's share of a query, so a
+	// dead first upstream leaves time to fail over.
+	upstreamAttemptTimeout = 2 * time.Second
+)
+
+// UpstreamStatus reports the health and counters of one upstream.
+type UpstreamStatus struct {
+	URI     string `json:"uri"`
+	Healthy bool   `json:"healthy"`
+	Queries uint64 `json:"queries"`
+	Errors  uint64 `json:"errors"`
+	// LatencyMillis is a moving average over successful exchanges and
+	// probes.
+	LatencyMillis float64    `json:"latencyMillis"`
+	LastError     string     `json:"lastError,omitempty"`
+	DownSince     *time.Time `json:"downSince,omitempty"`
+}
+
+type upstreamMember struct {
+	Upstream
+
+	mu        sync.Mutex
+	healthy   bool
+	failures  int
+	queries   uint64
+	errors    uint64
+	latency   time.Duration
+	lastError string
+	downSince time.Time
+}
+
+// record counts a client query against the upstream and updates its health.
+func (m *upstreamMember) record(latency time.Duration, err error) {
+	m.mu.Lock()
+	m.queries++
+	if err != nil {
+		m.errors++
+	}
+	m.mu.Unlock()
+	m.observe(latency, err)
+}
+
+// observe updates health and latency from a query or probe.
+func (m *upstreamMember) observe(latency time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.failures++
+		m.lastError = err.Error()
+		if m.healthy && m.failures >= upstreamDownAfter {
+			m.healthy = false
+			m.downSince = time.Now().UTC()
+			log.Printf("dns: upstream %s marked down: %v", m, err)
+		}
+		return
+	}
+	m.failures = 0
+	if m.latency == 0 {
+		m.latency = latency
+	} else {
+		m.latency = (7*m.latency + latency) / 8
+	}
+	if !m.healthy {
+		m.healthy = true
+		m.downSince = time.Time{}
+		log.Printf("dns: upstream %s is back up", m)
+	}
+}
+
+func (m *upstreamMember) status() UpstreamStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := UpstreamStatus{
+		URI:           m.String(),
+		Healthy:       m.healthy,
+		Queries:       m.queries,
+		Errors:        m.errors,
+		LatencyMillis: float64(m.latency.Microseconds()) / 1000,
+		LastError:     m.lastError,
+	}
+	if !m.healthy {
+		downSince := m.downSince
+		status.DownSince = &downSince
+	}
+	return status
+}
+
+// upstreamPool spreads queries over several upstreams according to a
+// strategy and fails over to the next one when an upstream errors. It is
+// itself an Upstream.
+type upstreamPool struct {
+	strategy string
+	members  []*upstreamMember
+	next     atomic.Uint64
+}
+
+func newUpstreamPool(uris []string, strategy string, opts UpstreamOptions) (*upstreamPool, error) {
+	switch strategy {
+	case "":
+		strategy = StrategyFailover
+	case StrategyFailover, StrategyRoundRobin, StrategyFastest:
+	default:
+		return nil, fmt.Errorf("unknown upstream strategy %q", strategy)
+	}
+	if len(uris) == 0 {
+		return nil, errors.New("no upstreams configured")
+	}
+	pool := &upstreamPool{strategy: strategy}
+	for _, uri := range uris {
+		upstream, err := ParseUpstream(uri, opts)
+		if err != nil {
+			_ = pool.Close()
+			return nil, err
+		}
+		pool.members = append(pool.members, &upstreamMember{Upstream: upstream, healthy: true})
+	}
+	return pool, nil
+}
+
+// order returns the members to try for one query: healthy ones in strategy
+// order, then the ones marked down as a last resort.
+func (p *upstreamPool) order() []*upstreamMember {
+	type candidate struct {
+		member  *upstreamMember
+		healthy bool
+		latency time.Duration
+	}
+	n := len(p.members)
+	start := 0
+	if p.strategy == StrategyRoundRobin {
+		start = int((p.next.Add(1) - 1) % uint64(n))
+	}
+	candidates := make([]candidate, 0, n)
+	for i := 0; i < n; i++ {
+		m := p.members[(start+i)%n]
+		m.mu.Lock()
+		candidates = append(candidates, candidate{member: m, healthy: m.healthy, latency: m.latency})
+		m.mu.Unlock()
+	}
+	if p.strategy == StrategyFastest {
+		// Unmeasured upstreams sort first so they get a latency.
+		sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].latency < candidates[j].latency })
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].healthy && !candidates[j].healthy })
+	members := make([]*upstreamMember, 0, n)
+	for _, c := range candidates {
+		members = append(members, c.member)
+	}
+	return members
+}
+
+// Exchange sends query to the upstreams in turn until one answers. SERVFAIL
+// and REFUSED count as failures; if no upstream does better, the last such
+// answer is returned.
+func (p *upstreamPool) Exchange(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	var (
+		fallback *dns.Msg
+		errs     []error
+	)
+	for _, m := range p.order() {
+		if ctx.Err() != nil {
+			break
+		}
+		attemptCtx, cancel := context.WithTimeout(ctx, upstreamAttemptTimeout)
+		started := time.Now()
+		resp, err := m.Exchange(attemptCtx, query)
+		cancel()
+		if err == nil && (resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused) {
+			fallback = resp
+			err = fmt.Errorf("%s answered %s", m, dns.RcodeToString[resp.Rcode])
+		}
+		m.record(time.Since(started), err)
+		if err == nil {
+			return resp, nil
+		}
+		errs = append(errs, err)
+	}
+	if fallback != nil {
+		return fallback, nil
+	}
+	if len(errs) == 0 {
+		return nil, ctx.Err()
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Run probes every upstream each interval until ctx is cancelled, so a
+// downed upstream comes back without waiting for client traffic.
+func (p *upstreamPool) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultHealthInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var wg sync.WaitGroup
+		for _, m := range p.members {
+			wg.Add(1)
+			go func(m *upstreamMember) {
+				defer wg.Done()
+				m.probe(ctx)
+			}(m)
+		}
+		wg.Wait()
+	}
+}
+
+// probe asks the upstream for the root NS records.
+func (m *upstreamMember) probe(ctx context.Context) {
+	probeCtx, cancel := context.WithTimeout(ctx, upstreamAttemptTimeout)
+	defer cancel()
+	msg := new(dns.Msg)
+	msg.SetQuestion(".", dns.TypeNS)
+	started := time.Now()
+	resp, err := m.Exchange(probeCtx, msg)
+	if ctx.Err() != nil {
+		// Shutting down; don't hold it against the upstream.
+		return
+	}
+	if err == nil && resp.Rcode == dns.RcodeServerFailure {
+		err = fmt.Errorf("%s answered SERVFAIL to probe", m)
+	}
+	m.observe(time.Since(started), err)
+}
+
+func (p *upstreamPool) String() string {
+	uris := make([]string, 0, len(p.members))
+	for _, m := range p.members {
+		uris = append(uris, m.String())
+	}
+	return p.strategy + "(" + strings.Join(uris, ", ") + ")"
+}
+
+// Primary returns the first healthy upstream in configured order, or the
+// first one when all are down.
+func (p *upstreamPool) Primary() string {
+	for _, m := range p.members {
+		m.mu.Lock()
+		healthy := m.healthy
+		m.mu.Unlock()
+		if healthy {
+			return m.String()
+		}
+	}
+	return p.members[0].String()
+}
+
+func (p *upstreamPool) Status() []UpstreamStatus {
+	statuses := make([]UpstreamStatus, 0, len(p.members))
+	for _, m := range p.members {
+		statuses = append(statuses, m.status())
+	}
+	return statuses
+}
+
+func (p *upstreamPool) Close() error {
+	var errs []error
+	for _, m := range p.members {
+		if err := m.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -29,8 +29,10 @@ func (m *WireGuardManager) Ensure(ctx context.Context, nodes []NodeStatus) error
 		if err := run(ctx, "ip", "link", "set", "up", "dev", iface); err != nil {
 			return fmt.Errorf("link up %s: %w", iface, err)
 		}
-		if err := run(ctx, "ip", "route", "replace", "default", "dev", iface, "table", fmt.Sprint(node.TableID)); err != nil {
-			return fmt.Errorf("route table %d: %w", node.TableID, err)
+		for _, family := range ipFamilies() {
+			if err := run(ctx, "ip", family, "route", "replace", "default", "dev", iface, "table", fmt.Sprint(node.TableID)); err != nil {
+				return fmt.Errorf("ip %s route table %d: %w", family, node.TableID, err)
+			}
 		}
 	}
 	return nil
@@ -71,3 +73,26 @@ func run(ctx context.Context, name string, args ...string) error {
 	}
 	return nil
 }
+
+// runInput is run with input fed to the command's stdin.
+func runInput(ctx context.Context, input string, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = strings.NewReader(input)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %w (%s)", name, strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// output is run returning the command's stdout.
+func output(ctx context.Context, name string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %w (%s)", name, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
@@ -0,0 +1,19 @@
+const apiKey = import.meta.env.VITE_API_KEY || ''
+const apiHeader = import.meta.env.VITE_API_HEADER || 'X-API-Key'
+
+export async function apiFetch(path, { method = 'GET', body } = {}) {
+  const headers = { [apiHeader]: apiKey }
+  if (body !== undefined) {
+    headers['Content-Type'] = 'application/json'
+  }
+  const response = await fetch(path, {
+    method,
+    headers,
+    body: body === undefined ? undefined : JSON.stringify(body)
+  })
+  const data = await response.json().catch(() => null)
+  if (!response.ok) {
+    throw new Error((data && data.message) || response.statusText)
+  }
+  return data
+}
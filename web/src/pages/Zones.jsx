@@ -1,26 +1,103 @@
-const sampleZones = [
-  {
-    name: 'us-east',
-    description: 'Primary exits for US East.'
-  },
-  {
-    name: 'eu-central',
-    description: 'Regional gateways for Europe.'
-  }
-]
+import { useEffect, useState } from 'react'
+import { apiFetch } from '../api.js'
+
+const emptyForm = { id: null, name: '', description: '', cidrs: '' }
+
+function splitCIDRs(value) {
+  return value
+    .split(',')
+    .map((cidr) => cidr.trim())
+    .filter(Boolean)
+}
 
 export default function Zones() {
+  const [zones, setZones] = useState([])
+  const [form, setForm] = useState(emptyForm)
+  const [error, setError] = useState('')
+
+  async function load() {
+    try {
+      setZones((await apiFetch('/api/zones')) || [])
+      setError('')
+    } catch (err) {
+      setError(err.message)
+    }
+  }
+
+  useEffect(() => {
+    load()
+  }, [])
+
+  async function save(event) {
+    event.preventDefault()
+    const zone = {
+      name: form.name.trim(),
+      description: form.description.trim(),
+      cidrs: splitCIDRs(form.cidrs)
+    }
+    try {
+      if (form.id === null) {
+        await apiFetch('/api/zones', { method: 'POST', body: zone })
+      } else {
+        await apiFetch(`/api/zones/${form.id}`, { method: 'PUT', body: zone })
+      }
+      setForm(emptyForm)
+      await load()
+    } catch (err) {
+      setError(err.message)
+    }
+  }
+
+  function edit(zone) {
+    setForm({
+      id: zone.id,
+      name: zone.name,
+      description: zone.description,
+      cidrs: zone.cidrs.join(', ')
+    })
+  }
+
   return (
     <section>
       <header className="page-header">
         <h1>Zones</h1>
         <p>Logical groupings for routing policy decisions.</p>
       </header>
+      {error && <p className="error">{error}</p>}
+      <form className="form card" onSubmit={save}>
+        <input
+          placeholder="Name"
+          value={form.name}
+          onChange={(e) => setForm({ ...form, name: e.target.value })}
+          required
+        />
+        <input
+          placeholder="Description"
+          value={form.description}
+          onChange={(e) => setForm({ ...form, description: e.target.value })}
+        />
+        <input
+          placeholder="CIDRs, comma separated"
+          value={form.cidrs}
+          onChange={(e) => setForm({ ...form, cidrs: e.target.value })}
+        />
+        <button type="submit">{form.id === null ? 'Create zone' : 'Save zone'}</button>
+        {form.id !== null && (
+          <button type="button" onClick={() => setForm(emptyForm)}>
+            Cancel
+          </button>
+        )}
+      </form>
       <div className="cards">
-        {sampleZones.map((zone) => (
-          <div className="card" key={zone.name}>
+        {zones.map((zone) => (
+          <div className="card" key={zone.id}>
             <h3>{zone.name}</h3>
             <p>{zone.description}</p>
+            <p>CIDRs: {zone.cidrs.join(', ') || 'any'}</p>
+            <p>Nodes: {zone.nodes.join(', ') || 'none'}</p>
+            <button type="button" onClick={() => edit(zone)}>
+              Edit
+            </button>
           </div>
         ))}
       </div>